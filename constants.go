@@ -8,17 +8,51 @@ const (
 	annotationAttribute = "attr"
 	annotationRelation  = "relation"
 	annotationExtends   = "extends"
+	annotationMeta      = "meta"
 	annotationOmitEmpty = "omitempty"
 	annotationISO8601   = "iso8601"
+	annotationDateOnly  = "dateonly"
+	annotationKeepZero  = "keepzero"
+	annotationKeepID    = "keepid"
+	annotationKeep      = "keep"
+	annotationLinkOnly  = "linkonly"
+	annotationMap       = "map"
+	annotationIDsOnly   = "idsonly"
+	annotationLayout    = "layout="
+	annotationFormat    = "format="
+	annotationNullIf    = "nullif="
+	annotationNested    = "nested"
+	annotationReadOnly  = "readonly"
 	annotationSeperator = ","
 
+	// separates the keys of a nested attribute path, e.g. "address.city"
+	annotationPathSeparator = "."
+
+	// relation tag argument prefix naming a sibling []string field holding the
+	// linkage ids, e.g. "relation,posts,ids:PostIDs"
+	annotationRelationIDs = "ids:"
+
+	// relation or attr tag argument prefix naming a sibling bool field
+	// recording whether the member is present, e.g.
+	// "relation,owner,touched:OwnerSet"
+	annotationTouched = "touched:"
+
 	iso8601TimeFormat = "2006-01-02T15:04:05Z"
+	dateOnlyFormat    = "2006-01-02"
+
+	// LocalIDMember is the JSON API 1.1 resource member holding a client
+	// generated id, see WithClientIDMember
+	LocalIDMember = "lid"
 
 	// MediaType is the identifier for the JSON API media type
 	//
 	// see http://jsonapi.org/format/#document-structure
 	MediaType = "application/vnd.api+json"
 
+	// the JSON API version a document is assumed to follow when it doesn't
+	// declare one
+	defaultJSONAPIVersion = "1.0"
+
 	// Pagination Constants
 	//
 	// http://jsonapi.org/format/#fetching-pagination
@@ -35,6 +69,9 @@ const (
 	// KeyNextPage is the key to the links object whose value contains a link to
 	// the next page of data
 	KeyNextPage = "next"
+	// KeyTotalCount is the key to the meta object whose value is the total
+	// number of resources across all pages of a collection
+	KeyTotalCount = "total-count"
 
 	// QueryParamPageNumber is a JSON API query parameter used in a page based
 	// pagination strategy in conjunction with QueryParamPageSize
@@ -45,6 +45,14 @@ value arguments are comma separated.  The first argument must be, "primary", and
 the second must be the name that should appear in the "type" field for all data
 objects that represent this type of model.
 
+A nil pointer id is left out of the payload. The extra argument "keepid" emits the
+zero value instead, e.g. "0", for resources where the zero id is meaningful.
+
+Besides strings and integers, the id may be an opaque struct, e.g. an encrypted token, that
+implements fmt.Stringer to marshal and IDParser or encoding.TextUnmarshaler to unmarshal.
+Any id type, e.g. a UUID, may instead implement IDMarshaler and IDUnmarshaler, which take
+precedence over the built-in handling.
+
 Value, attr: "attr,<key name in attributes hash>[,<extra arguments>]"
 
 These fields' values should end up in the "attribute" hash for a record.  The first
@@ -55,6 +63,21 @@ The following extra arguments are also supported:
 
 "omitempty": excludes the fields value from the "attribute" hash.
 "iso8601": uses the ISO8601 timestamp format when serialising or deserialising the time.Time value.
+"dateonly": uses the YYYY-MM-DD date format for a time.Time value, dropping the time of day.
+"keepzero": emits a zero time.Time value as null rather than omitting it.
+"rfc822", "rfc822z", "rfc1123", "rfc1123z", "rfc3339", "rfc3339nano": uses the named standard
+layout from the time package for a time.Time value.
+"layout=<layout>": uses a custom time package layout for a time.Time value, e.g.
+"attr,published,layout=Mon, 02 Jan 2006 15:04:05 MST". It must be the last argument as the layout
+takes the rest of the tag, commas included. "format=<layout>" is accepted as a synonym.
+"nullif=<value>": maps a numeric sentinel to null, e.g. "attr,rating,nullif=-1" emits null when the
+value is -1 and sets -1 when the attribute is null.
+"touched:<FieldName>": names a sibling bool field that makes the attribute tri-state, e.g. for PATCH
+semantics with a pointer field. On marshal the attribute is left out while the field is false, and
+emitted, as null when the pointer is nil, once it is true. On unmarshal the field is set when the
+attribute is present, even when null.
+"nested": treats dots in the key name as a path into nested objects, e.g. "attr,address.city,nested"
+is read from and written to {"address": {"city": ...}} rather than a literal "address.city" key.
 
 Value, relation: "relation,<key name in relationships hash>"
 
@@ -63,6 +86,41 @@ jsonapi will traverse the graph of relationships and marshal or unmarshal record
 argument must be, "relation", and the second should be the name of the relationship, used as
 the key in the "relationships" hash for the record.
 
+The following extra arguments are also supported:
+
+"omitempty": excludes the relationship when the field is nil or an empty slice.
+"keep": always emits the relationship, e.g. as {"data": []}, even when WithOmitEmptyRelationships
+is used.
+"linkonly": emits only the links and meta given by RelationshipLinkable and RelationshipMetable,
+without any "data" linkage, e.g. for lazily loaded relationships. The related models are neither
+visited nor sideloaded. Without links the relationship is emitted as usual.
+"map": declares a to-many relationship whose field is a map of the related models keyed by their
+id, e.g. map[string]*Comment. The linkage is marshaled in key order; unmarshaling linkage without
+an id or with a duplicate id returns ErrInvalidRelationKey.
+"ids:<FieldName>": names a sibling []string field that is filled with the linkage ids on unmarshal,
+alongside the related models, and used to build the linkage on marshal when the related models
+slice is empty.
+"idsonly": together with "ids:", reads and writes the relationship through the ids field alone. On
+unmarshal no related models are built, and on marshal the linkage is built from the ids whatever
+the related models; a to-one relationship is linked from its single id, or null without one.
+"touched:<FieldName>": names a sibling bool field that makes the relationship tri-state, e.g. for
+PATCH semantics. On marshal the relationship is left out while the field is false, and emitted,
+as null when the related model is nil, once it is true. On unmarshal the field is set when the
+relationship is present, even with null data.
+
+Value, meta: "meta[,<key name in meta hash>[,<extra arguments>]]"
+
+With a key name, these fields' values end up in the "meta" hash for a record. A bare "meta"
+tag holds the whole "meta" hash instead, e.g. in a typed struct, which is converted with
+encoding/json so its json tags apply; a nil pointer or an empty object is omitted. Either way
+the Metable interface takes precedence on a clashing key.
+
+The following extra arguments are also supported:
+
+"omitempty": excludes the field's zero value from the "meta" hash.
+"readonly": emits the value on marshal but ignores it on unmarshal, for server computed meta
+that clients must not be able to set.
+
 Use the methods below to Marshal and Unmarshal jsonapi.org json payloads.
 
 Visit the readme at https://github.com/google/jsonapi
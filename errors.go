@@ -42,10 +42,22 @@ type ErrorObject struct {
 	// Code is an application-specific error code, expressed as a string value.
 	Code string `json:"code,omitempty"`
 
+	// Source is an object containing references to the source of the error.
+	Source *ErrorSource `json:"source,omitempty"`
+
 	// Meta is an object containing non-standard meta-information about the error.
 	Meta *map[string]interface{} `json:"meta,omitempty"`
 }
 
+// ErrorSource is the source member of a JSON API error object, pointing at what caused the error.
+type ErrorSource struct {
+	// Pointer is a JSON Pointer [RFC6901] to the associated entity in the request document, e.g. "/data/attributes/title".
+	Pointer string `json:"pointer,omitempty"`
+
+	// Parameter is a string indicating which URI query parameter caused the error.
+	Parameter string `json:"parameter,omitempty"`
+}
+
 // Error implements the `Error` interface.
 func (e *ErrorObject) Error() string {
 	return fmt.Sprintf("Error: %s %s\n", e.Title, e.Detail)
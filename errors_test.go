@@ -40,6 +40,13 @@ func TestMarshalErrorsWritesTheExpectedPayload(t *testing.T) {
 				map[string]interface{}{"title": "Test title.", "detail": "Test detail", "meta": map[string]interface{}{"key": "val"}},
 			}},
 		},
+		{
+			Title: "TestSourceFieldIsSerializedProperly",
+			In:    []*ErrorObject{{Title: "Test title.", Source: &ErrorSource{Pointer: "/data/attributes/title"}}},
+			Out: map[string]interface{}{"errors": []interface{}{
+				map[string]interface{}{"title": "Test title.", "source": map[string]interface{}{"pointer": "/data/attributes/title"}},
+			}},
+		},
 	}
 	for _, testRow := range marshalErrorsTableTasts {
 		t.Run(testRow.Title, func(t *testing.T) {
@@ -55,3 +62,27 @@ func TestMarshalErrorsWritesTheExpectedPayload(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorsPayloadRoundTrip(t *testing.T) {
+	in := []*ErrorObject{
+		{Status: "422", Title: "Invalid attribute", Source: &ErrorSource{Pointer: "/data/attributes/title"}},
+		{Status: "400", Title: "Invalid parameter", Source: &ErrorSource{Parameter: "sort"}},
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := MarshalErrors(buffer, in); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(buffer.Bytes(), []byte(`"data"`)) {
+		t.Fatalf("Was not expecting a data member, got %s", buffer)
+	}
+
+	out := new(ErrorsPayload)
+	if err := json.Unmarshal(buffer.Bytes(), out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out.Errors) {
+		t.Fatalf("Expected: \n%#v \nto equal: \n%#v", out.Errors, in)
+	}
+}
@@ -0,0 +1,116 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedMediaType is returned by CheckMediaType, wrapped with the
+	// header, when the request's Content-Type is the JSON API media type with
+	// parameters other than "ext" and "profile". Servers respond with
+	// http.StatusUnsupportedMediaType.
+	ErrUnsupportedMediaType = errors.New("unsupported media type parameters")
+	// ErrNotAcceptable is returned by CheckMediaType, wrapped with the header,
+	// when the request's Accept header lists the JSON API media type but only
+	// with parameters other than "ext" and "profile". Servers respond with
+	// http.StatusNotAcceptable.
+	ErrNotAcceptable = errors.New("no acceptable JSON API media type")
+)
+
+// CheckMediaType enforces the spec's content negotiation rules on a request,
+// returning ErrUnsupportedMediaType or ErrNotAcceptable so the caller can
+// respond with the matching status code, e.g.
+//
+//	if err := jsonapi.CheckMediaType(r); errors.Is(err, jsonapi.ErrNotAcceptable) {
+//		http.Error(w, err.Error(), http.StatusNotAcceptable)
+//		return
+//	}
+//
+// https://jsonapi.org/format/1.1/#content-negotiation-servers
+func CheckMediaType(r *http.Request) error {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if isMediaType, valid := checkMediaRange(contentType); isMediaType && !valid {
+			return fmt.Errorf("%w: %s", ErrUnsupportedMediaType, contentType)
+		}
+	}
+
+	accept := strings.Join(r.Header["Accept"], ",")
+	if accept == "" {
+		return nil
+	}
+
+	var listed bool
+	for _, mediaRange := range splitMediaRanges(accept) {
+		isMediaType, valid := checkMediaRange(mediaRange)
+		if isMediaType && valid {
+			return nil
+		}
+		listed = listed || isMediaType
+	}
+	if listed {
+		return fmt.Errorf("%w: %s", ErrNotAcceptable, accept)
+	}
+	return nil
+}
+
+// splitMediaRanges splits an Accept header on the commas between its media
+// ranges, leaving those inside quoted parameter values, e.g. a profile list.
+func splitMediaRanges(accept string) []string {
+	var (
+		ranges       []string
+		start        int
+		quoted, skip bool
+	)
+	for i, c := range accept {
+		switch {
+		case skip:
+			skip = false
+		case quoted && c == '\\':
+			skip = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			ranges = append(ranges, accept[start:i])
+			start = i + 1
+		}
+	}
+	return append(ranges, accept[start:])
+}
+
+// checkMediaRange reports whether mediaRange is the JSON API media type, and
+// if so whether its parameters are all allowed. The Accept header's quality
+// factor is allowed too.
+func checkMediaRange(mediaRange string) (isMediaType, valid bool) {
+	mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+	if err != nil || mediaType != MediaType {
+		return false, false
+	}
+
+	for name := range params {
+		switch name {
+		case "ext", "profile", "q":
+		default:
+			return true, false
+		}
+	}
+	return true, true
+}
+
+// WriteResponse writes a jsonapi response for models like MarshalPayload with
+// the given status code and the JSON API Content-Type. Nothing is written when
+// marshaling fails, so the caller may still respond with an error.
+func WriteResponse(w http.ResponseWriter, status int, models interface{}, opts ...Option) error {
+	payload, err := Marshal(models, opts...)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", MediaType)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,74 @@
+package jsonapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckMediaType(t *testing.T) {
+	for _, scenario := range []struct {
+		contentType string
+		accept      []string
+		err         error
+	}{
+		{},
+		{contentType: MediaType, accept: []string{MediaType}},
+		{contentType: "application/json", accept: []string{"*/*"}},
+		{contentType: MediaType + `; ext="https://jsonapi.org/ext/atomic"`},
+		{contentType: MediaType + "; charset=utf-8", err: ErrUnsupportedMediaType},
+		{accept: []string{MediaType + "; version=1", MediaType + "; q=0.5"}},
+		{accept: []string{"application/json", MediaType + `; profile="https://example.com/p"`}},
+		{accept: []string{MediaType + "; version=1"}, err: ErrNotAcceptable},
+		{accept: []string{"text/html", MediaType + "; charset=utf-8"}, err: ErrNotAcceptable},
+		{accept: []string{MediaType + `; profile="https://example.com/a,https://example.com/b"`}},
+		{accept: []string{MediaType + `; profile="https://example.com/a,b"; version=1`}, err: ErrNotAcceptable},
+		{accept: []string{`text/html; q="0,5", ` + MediaType}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/posts", nil)
+		if scenario.contentType != "" {
+			r.Header.Set("Content-Type", scenario.contentType)
+		}
+		for _, accept := range scenario.accept {
+			r.Header.Add("Accept", accept)
+		}
+
+		err := CheckMediaType(r)
+		if scenario.err == nil && err != nil || !errors.Is(err, scenario.err) {
+			t.Fatalf("Was expecting %v for %q and %q, got %v",
+				scenario.err, scenario.contentType, scenario.accept, err)
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	rr := httptest.NewRecorder()
+	if err := WriteResponse(rr, http.StatusCreated, &Comment{ID: 1, Body: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Was expecting status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	if e, a := MediaType, rr.Header().Get("Content-Type"); e != a {
+		t.Fatalf("Was expecting Content-Type %q, got %q", e, a)
+	}
+
+	comment := new(Comment)
+	if err := UnmarshalPayload(rr.Body, comment); err != nil {
+		t.Fatal(err)
+	}
+	if comment.Body != "hi" {
+		t.Fatalf("Was expecting the comment to be written, got %#v", comment)
+	}
+
+	// Nothing is written when marshaling fails
+	rr = httptest.NewRecorder()
+	if err := WriteResponse(rr, http.StatusOK, "nope"); err != ErrUnexpectedType {
+		t.Fatalf("Was expecting ErrUnexpectedType, got %v", err)
+	}
+	if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") != "" {
+		t.Fatal("Was expecting nothing to be written")
+	}
+}
@@ -1,7 +1,11 @@
 package jsonapi
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -31,6 +35,222 @@ type Timestamp struct {
 	Next *time.Time `jsonapi:"attr,next,iso8601"`
 }
 
+type Person struct {
+	ID          int        `jsonapi:"primary,people"`
+	Birthday    time.Time  `jsonapi:"attr,dob,dateonly"`
+	Anniversary *time.Time `jsonapi:"attr,anniversary,dateonly,omitempty"`
+}
+
+type Document struct {
+	ID       int    `jsonapi:"primary,documents"`
+	Title    string `jsonapi:"attr,title"`
+	Revision int    `jsonapi:"meta,revision,omitempty"`
+	Verified bool   `jsonapi:"meta,verified,readonly"`
+}
+
+type Article struct {
+	ID        int        `jsonapi:"primary,articles"`
+	Published time.Time  `jsonapi:"attr,published,layout=Mon, 02 Jan 2006 15:04:05 MST"`
+	Updated   *time.Time `jsonapi:"attr,updated,rfc1123,omitempty"`
+	Archived  *time.Time `jsonapi:"attr,archived,omitempty,format=02/01/2006"`
+}
+
+// Instant is a named time type, without time.Time's methods
+type Instant time.Time
+
+type Session struct {
+	ID     int       `jsonapi:"primary,sessions"`
+	Starts Instant   `jsonapi:"attr,starts,iso8601"`
+	Ends   *Instant  `jsonapi:"attr,ends,omitempty"`
+	Reruns []Instant `jsonapi:"attr,reruns,dateonly,omitempty"`
+}
+
+type Schedule struct {
+	ID       int          `jsonapi:"primary,schedules"`
+	Holidays []time.Time  `jsonapi:"attr,holidays,iso8601"`
+	Closures []*time.Time `jsonapi:"attr,closures,dateonly,omitempty"`
+	Openings []time.Time  `jsonapi:"attr,openings,omitempty"`
+}
+
+type Listing struct {
+	ID     int     `jsonapi:"primary,listings"`
+	Rank   int     `jsonapi:"attr,rank,nullif=-1"`
+	Rating float32 `jsonapi:"attr,rating,nullif=-1"`
+}
+
+// Money is an amount in cents, emitted as a decimal string and a currency
+type Money struct {
+	Cents    int64
+	Currency string
+}
+
+func (m Money) MarshalJSONAPIAttribute() (interface{}, error) {
+	if m.Currency == "" {
+		return nil, fmt.Errorf("amount %d has no currency", m.Cents)
+	}
+	return map[string]interface{}{
+		"amount":   fmt.Sprintf("%d.%02d", m.Cents/100, m.Cents%100),
+		"currency": m.Currency,
+	}, nil
+}
+
+func (m *Money) UnmarshalJSONAPIAttribute(v interface{}) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid money %v", v)
+	}
+
+	var units, cents int64
+	if _, err := fmt.Sscanf(fmt.Sprint(obj["amount"]), "%d.%d", &units, &cents); err != nil {
+		return fmt.Errorf("invalid amount %v", obj["amount"])
+	}
+	m.Cents = units*100 + cents
+	m.Currency, _ = obj["currency"].(string)
+	return nil
+}
+
+type Quote struct {
+	ID       int     `jsonapi:"primary,quotes"`
+	Subtotal float64 `jsonapi:"attr,subtotal"`
+	Total    float64 `jsonapi:"attr,total"`
+}
+
+type Invoice struct {
+	ID       int    `jsonapi:"primary,invoices"`
+	Total    Money  `jsonapi:"attr,total"`
+	Discount *Money `jsonapi:"attr,discount,omitempty"`
+}
+
+type Preference struct {
+	ID       int              `jsonapi:"primary,preferences"`
+	Settings json.RawMessage  `jsonapi:"attr,settings"`
+	Extra    *json.RawMessage `jsonapi:"attr,extra,omitempty"`
+}
+
+type Site struct {
+	ID       int      `jsonapi:"primary,sites"`
+	Homepage *url.URL `jsonapi:"attr,homepage"`
+	Mirror   url.URL  `jsonapi:"attr,mirror,omitempty"`
+}
+
+type Answer struct {
+	Question string `json:"question"`
+	Choice   int    `json:"choice"`
+}
+
+type Survey struct {
+	ID      int       `jsonapi:"primary,surveys"`
+	Scores  []int     `jsonapi:"attr,scores"`
+	Weights []float64 `jsonapi:"attr,weights"`
+	Answers []Answer  `jsonapi:"attr,answers"`
+}
+
+type Asset struct {
+	ID       int                    `jsonapi:"primary,assets"`
+	Metadata map[string]string      `jsonapi:"attr,metadata"`
+	Counts   map[string]int         `jsonapi:"attr,counts"`
+	Extra    map[string]interface{} `jsonapi:"attr,extra"`
+	Labels   *map[string]string     `jsonapi:"attr,labels,omitempty"`
+}
+
+type Page struct {
+	ID    int    `jsonapi:"primary,pages"`
+	Title string `jsonapi:"attr,title"`
+	Slug  string
+}
+
+func (p *Page) AfterUnmarshalJSONAPI() error {
+	p.Title = strings.TrimSpace(p.Title)
+	if p.Title == "" {
+		return fmt.Errorf("page %d has no title", p.ID)
+	}
+	p.Slug = strings.ToLower(strings.Replace(p.Title, " ", "-", -1))
+	return nil
+}
+
+type Feed struct {
+	ID        int           `jsonapi:"primary,feeds"`
+	Items     []interface{} `jsonapi:"relation,items"`
+	Publisher Publisher     `jsonapi:"relation,publisher"`
+}
+
+// Publisher is implemented by the resources a feed may be published by
+type Publisher interface {
+	PublisherName() string
+}
+
+func (a *Author) PublisherName() string {
+	return a.Name
+}
+
+func (b *Blog) PublisherName() string {
+	return b.Title
+}
+
+type ReportMeta struct {
+	GeneratedBy string `json:"generated-by"`
+	Rows        int    `json:"rows,omitempty"`
+}
+
+type Report struct {
+	ID    int         `jsonapi:"primary,reports"`
+	Title string      `jsonapi:"attr,title"`
+	Meta  *ReportMeta `jsonapi:"meta"`
+}
+
+type Blogs []*Blog
+
+func (b Blogs) JSONAPIMeta() *Meta {
+	return &Meta{"page-size": len(b)}
+}
+
+type Review struct {
+	ID     int     `jsonapi:"primary,reviews"`
+	Body   string  `jsonapi:"attr,body"`
+	Author Author  `jsonapi:"relation,author"`
+	Editor Account `jsonapi:"relation,editor,omitempty"`
+}
+
+// NullableString is zero when it isn't valid, whatever its string
+type NullableString struct {
+	String string
+	Valid  bool
+}
+
+func (n NullableString) IsZero() bool {
+	return !n.Valid
+}
+
+type Contact struct {
+	ID       int            `jsonapi:"primary,contacts"`
+	Nickname NullableString `jsonapi:"attr,nickname,omitempty"`
+}
+
+type roleKey struct{}
+
+type Employee struct {
+	ID      int       `jsonapi:"primary,employees"`
+	Name    string    `jsonapi:"attr,name"`
+	Salary  int       `jsonapi:"attr,salary"`
+	Manager *Employee `jsonapi:"relation,manager"`
+}
+
+func (e *Employee) JSONAPIVisibleFields(ctx context.Context) (attrs, rels []string) {
+	if ctx.Value(roleKey{}) == "admin" {
+		return []string{"name", "salary"}, []string{"manager"}
+	}
+	return []string{"name"}, nil
+}
+
+type Task struct {
+	ID              int     `jsonapi:"primary,tasks"`
+	Title           string  `jsonapi:"attr,title"`
+	Notes           *string `jsonapi:"attr,notes,touched:NotesTouched"`
+	NotesTouched    bool
+	Assignee        *Author `jsonapi:"relation,assignee,touched:AssigneeTouched"`
+	AssigneeTouched bool
+}
+
 type Car struct {
 	ID    *string `jsonapi:"primary,cars"`
 	Make  *string `jsonapi:"attr,make,omitempty"`
@@ -155,3 +375,332 @@ func (bc *BadComment) JSONAPILinks() *Links {
 		"self": []string{"invalid", "should error"},
 	}
 }
+
+type Author struct {
+	ID          int    `jsonapi:"primary,authors"`
+	Name        string `jsonapi:"attr,name"`
+	Recommended []*Book
+}
+
+func (a *Author) JSONAPIComputedRelationships(included *map[string]*Node, sideload bool) map[string]interface{} {
+	nodes := []*Node{}
+	for _, b := range a.Recommended {
+		n := &Node{Type: "books", ID: fmt.Sprintf("%d", b.ID)}
+		if sideload {
+			appendIncluded(included, &Node{
+				Type:       n.Type,
+				ID:         n.ID,
+				Attributes: map[string]interface{}{"title": b.Title},
+			})
+		}
+		nodes = append(nodes, n)
+	}
+
+	return map[string]interface{}{
+		"recommended": &RelationshipManyNode{Data: nodes},
+	}
+}
+
+type Shelf struct {
+	ID    int     `jsonapi:"primary,shelves"`
+	Books []*Book `jsonapi:"relation,books,keep"`
+	Owner *Author `jsonapi:"relation,owner"`
+}
+
+type Account struct {
+	ID       int     `jsonapi:"primary,accounts"`
+	Email    string  `jsonapi:"attr,email"`
+	Password string  `jsonapi:"attr,password"`
+	Owner    *Author `jsonapi:"relation,owner"`
+	Auditor  *Author `jsonapi:"relation,auditor"`
+}
+
+func (a *Account) JSONAPIExposedFields() []string {
+	return []string{"email", "owner"}
+}
+
+type Member struct {
+	ID   int    `jsonapi:"primary,users"`
+	Name string `jsonapi:"attr,name"`
+	Role string
+}
+
+func (m *Member) JSONAPILinkageMeta() *Meta {
+	return &Meta{"role": m.Role}
+}
+
+func (m *Member) SetJSONAPILinkageMeta(meta *Meta) {
+	m.Role, _ = (*meta)["role"].(string)
+}
+
+type Group struct {
+	ID      int       `jsonapi:"primary,groups"`
+	Owner   *Member   `jsonapi:"relation,owner"`
+	Members []*Member `jsonapi:"relation,members"`
+}
+
+type Chapter struct {
+	ID   int       `jsonapi:"primary,chapters"`
+	Next *Chapter  `jsonapi:"relation,next"`
+	Refs []*Author `jsonapi:"relation,refs"`
+}
+
+func (c *Chapter) JSONAPILinks() *Links {
+	return &Links{
+		"self": fmt.Sprintf("/chapters/%d", c.ID),
+		"canonical": Link{
+			Href: fmt.Sprintf("chapters/%d/canonical", c.ID),
+		},
+		"external": "https://example.org/books",
+	}
+}
+
+func (c *Chapter) JSONAPIRelationshipLinks(relation string) *Links {
+	return &Links{
+		"related": fmt.Sprintf("/chapters/%d/%s", c.ID, relation),
+	}
+}
+
+type Notice struct {
+	ID   string `jsonapi:"primary,notices"`
+	Text string `jsonapi:"attr,text"`
+}
+
+func (n *Notice) JSONAPIGenerateID() string {
+	return "generated-" + n.Text
+}
+
+type UUID [16]byte
+
+func (u UUID) JSONAPIID() (string, error) {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+func (u *UUID) SetJSONAPIID(id string) error {
+	var b []byte
+	if _, err := fmt.Sscanf(strings.Replace(id, "-", "", -1), "%x", &b); err != nil || len(b) != len(u) {
+		return fmt.Errorf("invalid uuid %q", id)
+	}
+	copy(u[:], b)
+	return nil
+}
+
+type Device struct {
+	ID   UUID   `jsonapi:"primary,devices"`
+	Name string `jsonapi:"attr,name"`
+}
+
+type Base struct {
+	ID    int     `jsonapi:"primary,bases"`
+	Name  string  `jsonapi:"attr,name"`
+	Owner *Author `jsonapi:"relation,owner"`
+}
+
+type Audit struct {
+	Revision int `jsonapi:"attr,revision"`
+}
+
+type Folder struct {
+	Base
+	*Audit
+	ID   int    `jsonapi:"primary,folders"`
+	Name string `jsonapi:"attr,name"`
+}
+
+type Category struct {
+	ID     int       `jsonapi:"primary,categories"`
+	Name   string    `jsonapi:"attr,name"`
+	Parent *Category `jsonapi:"relation,parent"`
+}
+
+type Fragile struct {
+	ID    int      `jsonapi:"primary,fragiles"`
+	Child *Fragile `jsonapi:"relation,child"`
+}
+
+func (f *Fragile) AfterUnmarshalJSONAPI() error {
+	if f.ID == 2 {
+		panic("fragile 2")
+	}
+	return nil
+}
+
+type Receipt struct {
+	ID    int    `jsonapi:"primary,receipts"`
+	Title string `jsonapi:"attr,title"`
+}
+
+func (r *Receipt) JSONAPIMeta() *Meta {
+	return &Meta{"generated": true}
+}
+
+func (r *Receipt) JSONAPITopLevelMeta() *Meta {
+	return &Meta{"request-id": "abc"}
+}
+
+type Moderated struct {
+	ID       int        `jsonapi:"primary,moderated"`
+	Comments []*Comment `jsonapi:"relation,comments"`
+	Hidden   map[int]bool
+}
+
+func (m *Moderated) JSONAPIIncludeRelationElement(relation string, element interface{}) bool {
+	return relation != "comments" || !m.Hidden[element.(*Comment).ID]
+}
+
+type Membership struct {
+	ID           int       `jsonapi:"primary,memberships"`
+	Owner        *Member   `jsonapi:"relation,owner"`
+	Members      []*Member `jsonapi:"relation,members"`
+	RelationMeta map[string]*Meta
+}
+
+func (m *Membership) SetJSONAPIRelationshipMeta(relation string, meta *Meta) {
+	if m.RelationMeta == nil {
+		m.RelationMeta = make(map[string]*Meta)
+	}
+	m.RelationMeta[relation] = meta
+}
+
+type Discussion struct {
+	ID       int                 `jsonapi:"primary,discussions"`
+	Comments map[string]*Comment `jsonapi:"relation,comments,map"`
+}
+
+type Draft struct {
+	ID    int    `jsonapi:"primary,drafts"`
+	Title string `jsonapi:"attr,title"`
+}
+
+func (d *Draft) JSONAPIAttributeLinks() map[string]string {
+	return map[string]string{"publish": fmt.Sprintf("/drafts/%d/publish", d.ID)}
+}
+
+type userKey struct{}
+
+type Dashboard struct {
+	ID      int    `jsonapi:"primary,dashboards"`
+	Version int    `jsonapi:"meta,version"`
+	Source  string `jsonapi:"meta,source"`
+}
+
+func (d *Dashboard) JSONAPIMeta() *Meta {
+	return &Meta{"source": "metable", "cached": true}
+}
+
+func (d *Dashboard) JSONAPIComputedMeta(ctx context.Context) *Meta {
+	meta := Meta{"source": "computed", "user": ctx.Value(userKey{})}
+	return &meta
+}
+
+type Thread struct {
+	ID      int        `jsonapi:"primary,threads"`
+	Replies []*Comment `jsonapi:"relation,replies,linkonly"`
+	Starter *Comment   `jsonapi:"relation,starter,linkonly"`
+}
+
+func (t *Thread) JSONAPIRelationshipLinks(relation string) *Links {
+	if relation != "replies" {
+		return nil
+	}
+	return &Links{
+		"self":    fmt.Sprintf("/threads/%d/relationships/replies", t.ID),
+		"related": fmt.Sprintf("/threads/%d/replies", t.ID),
+	}
+}
+
+type Status int
+
+const (
+	StatusUnknown Status = iota
+	StatusActive
+	StatusArchived
+)
+
+var statusLabels = map[Status]string{StatusActive: "active", StatusArchived: "archived"}
+
+func (s Status) JSONAPIEnumValue() interface{} {
+	return statusLabels[s]
+}
+
+func (s *Status) JSONAPIEnumScan(v interface{}) error {
+	switch value := v.(type) {
+	case float64:
+		*s = Status(value)
+		return nil
+	case string:
+		for code, label := range statusLabels {
+			if label == value {
+				*s = code
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid status %v", v)
+}
+
+type Project struct {
+	ID       int     `jsonapi:"primary,projects"`
+	Status   Status  `jsonapi:"attr,status"`
+	Previous *Status `jsonapi:"attr,previous,omitempty"`
+}
+
+// Token is an opaque id of the form "shard.seq"
+type Token struct {
+	Shard int
+	Seq   int
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%d.%d", t.Shard, t.Seq)
+}
+
+func (t *Token) ParseID(id string) error {
+	if _, err := fmt.Sscanf(id, "%d.%d", &t.Shard, &t.Seq); err != nil {
+		return fmt.Errorf("invalid token %q", id)
+	}
+	return nil
+}
+
+// Cursor is an opaque id parsed as text
+type Cursor struct {
+	Value string
+}
+
+func (c Cursor) String() string {
+	return "c-" + c.Value
+}
+
+func (c *Cursor) UnmarshalText(text []byte) error {
+	c.Value = strings.TrimPrefix(string(text), "c-")
+	return nil
+}
+
+type Ticket struct {
+	ID      Token  `jsonapi:"primary,tickets"`
+	Subject string `jsonapi:"attr,subject"`
+}
+
+type Bookmark struct {
+	ID *Cursor `jsonapi:"primary,bookmarks"`
+}
+
+type Widget struct {
+	Tenant string
+	Number int    `jsonapi:"primary,widgets"`
+	Name   string `jsonapi:"attr,name"`
+}
+
+func (w *Widget) JSONAPIID() (string, error) {
+	if w.Tenant == "" {
+		return "", fmt.Errorf("widget %d has no tenant", w.Number)
+	}
+	return fmt.Sprintf("%s:%d", w.Tenant, w.Number), nil
+}
+
+func (w *Widget) JSONAPISetID(id string) error {
+	if _, err := fmt.Sscanf(strings.Replace(id, ":", " ", 1), "%s %d", &w.Tenant, &w.Number); err != nil {
+		return fmt.Errorf("invalid widget id %q", id)
+	}
+	return nil
+}
@@ -1,6 +1,13 @@
 package jsonapi
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
 
 // Payloader is used to encapsulate the One and Many payload types
 type Payloader interface {
@@ -10,10 +17,11 @@ type Payloader interface {
 // OnePayload is used to represent a generic JSON API payload where a single
 // resource (Node) was included as an {} in the "data" key
 type OnePayload struct {
-	Data     *Node   `json:"data"`
-	Included []*Node `json:"included,omitempty"`
-	Links    *Links  `json:"links,omitempty"`
-	Meta     *Meta   `json:"meta,omitempty"`
+	Data     *Node          `json:"data"`
+	Included []*Node        `json:"included,omitempty"`
+	Links    *Links         `json:"links,omitempty"`
+	Meta     *Meta          `json:"meta,omitempty"`
+	JSONAPI  *JSONAPIObject `json:"jsonapi,omitempty"`
 }
 
 func (p *OnePayload) clearIncluded() {
@@ -23,27 +31,49 @@ func (p *OnePayload) clearIncluded() {
 // ManyPayload is used to represent a generic JSON API payload where many
 // resources (Nodes) were included in an [] in the "data" key
 type ManyPayload struct {
-	Data     []*Node `json:"data"`
-	Included []*Node `json:"included,omitempty"`
-	Links    *Links  `json:"links,omitempty"`
-	Meta     *Meta   `json:"meta,omitempty"`
+	Data     []*Node        `json:"data"`
+	Included []*Node        `json:"included,omitempty"`
+	Links    *Links         `json:"links,omitempty"`
+	Meta     *Meta          `json:"meta,omitempty"`
+	JSONAPI  *JSONAPIObject `json:"jsonapi,omitempty"`
 }
 
 func (p *ManyPayload) clearIncluded() {
 	p.Included = []*Node{}
 }
 
+// JSONAPIObject is used to represent the top-level `jsonapi` object, in which
+// the server describes its implementation.
+// https://jsonapi.org/format/1.1/#document-jsonapi-object
+type JSONAPIObject struct {
+	Version string   `json:"version,omitempty"`
+	Ext     []string `json:"ext,omitempty"`
+	Profile []string `json:"profile,omitempty"`
+	Meta    *Meta    `json:"meta,omitempty"`
+}
+
 // Node is used to represent a generic JSON API Resource
 type Node struct {
 	Type          string                 `json:"type"`
 	ID            string                 `json:"id,omitempty"`
 	ClientID      string                 `json:"client-id,omitempty"`
+	LocalID       string                 `json:"lid,omitempty"`
 	Attributes    map[string]interface{} `json:"attributes,omitempty"`
 	Relationships map[string]interface{} `json:"relationships,omitempty"`
 	Links         *Links                 `json:"links,omitempty"`
 	Meta          *Meta                  `json:"meta,omitempty"`
 }
 
+// MarshalJSON writes the members of the resource object in the order the spec
+// recommends, which is the order of Node's fields: type, id, the client id,
+// attributes, relationships, links and meta. encoding/json sorts the keys
+// within the attributes, relationships and meta, so a node's output is
+// canonical; see WithCanonicalOutput for the order of the included resources.
+func (n Node) MarshalJSON() ([]byte, error) {
+	type node Node
+	return json.Marshal(node(n))
+}
+
 // RelationshipOneNode is used to represent a generic has one JSON API relation
 type RelationshipOneNode struct {
 	Data  *Node  `json:"data"`
@@ -59,6 +89,74 @@ type RelationshipManyNode struct {
 	Meta  *Meta   `json:"meta,omitempty"`
 }
 
+// RelationshipLinksNode is used to represent a relationship holding only links
+// and meta, without any resource linkage, see the "linkonly" relation argument
+type RelationshipLinksNode struct {
+	Links *Links `json:"links"`
+	Meta  *Meta  `json:"meta,omitempty"`
+}
+
+// RelationshipCursor returns where to continue a paginated relationship of a
+// decoded node: its "next" link, or else the "cursor" member of its meta.
+// ok is false when the relationship is missing or carries neither.
+func RelationshipCursor(node *Node, relName string) (next string, ok bool) {
+	if node == nil {
+		return "", false
+	}
+
+	var links, meta interface{}
+	switch r := node.Relationships[relName].(type) {
+	case map[string]interface{}:
+		links, meta = r["links"], r["meta"]
+	case *RelationshipManyNode:
+		links, meta = r.Links, r.Meta
+	case *RelationshipOneNode:
+		links, meta = r.Links, r.Meta
+	case *RelationshipLinksNode:
+		links, meta = r.Links, r.Meta
+	default:
+		return "", false
+	}
+
+	var nextLink interface{}
+	switch l := links.(type) {
+	case map[string]interface{}:
+		nextLink = l["next"]
+	case *Links:
+		if l != nil {
+			nextLink = (*l)["next"]
+		}
+	}
+	switch l := nextLink.(type) {
+	case string:
+		if l != "" {
+			return l, true
+		}
+	case Link:
+		if l.Href != "" {
+			return l.Href, true
+		}
+	case map[string]interface{}:
+		if href, _ := l["href"].(string); href != "" {
+			return href, true
+		}
+	}
+
+	var cursor interface{}
+	switch m := meta.(type) {
+	case map[string]interface{}:
+		cursor = m["cursor"]
+	case *Meta:
+		if m != nil {
+			cursor = (*m)["cursor"]
+		}
+	}
+	if c, _ := cursor.(string); c != "" {
+		return c, true
+	}
+	return "", false
+}
+
 // Links is used to represent a `links` object.
 // http://jsonapi.org/format/#document-links
 type Links map[string]interface{}
@@ -73,7 +171,7 @@ func (l *Links) validate() (err error) {
 	//            link.
 	for k, v := range *l {
 		_, isString := v.(string)
-		_, isLink := v.(Link)
+		link, isLink := v.(Link)
 
 		if !(isString || isLink) {
 			return fmt.Errorf(
@@ -81,14 +179,82 @@ func (l *Links) validate() (err error) {
 				k,
 			)
 		}
+
+		if isLink {
+			if err := link.validate(); err != nil {
+				return fmt.Errorf("The %s member of the links object %v", k, err)
+			}
+		}
 	}
 	return
 }
 
-// Link is used to represent a member of the `links` object.
+func (l Link) validate() error {
+	switch l.Hreflang.(type) {
+	case nil, string, []string:
+	default:
+		return errors.New("had a hreflang that was not a string or array of strings")
+	}
+
+	switch describedBy := l.DescribedBy.(type) {
+	case nil, string:
+	case Link:
+		return describedBy.validate()
+	default:
+		return errors.New("had a describedby that was not a string or link object")
+	}
+
+	return nil
+}
+
+// withBaseURL returns a copy of the links with every relative href prefixed
+// by base; absolute hrefs are left untouched. The receiver isn't modified as
+// it is usually owned by a Linkable implementation.
+func (l *Links) withBaseURL(base string) *Links {
+	if l == nil {
+		return nil
+	}
+
+	links := make(Links, len(*l))
+	for k, v := range *l {
+		switch link := v.(type) {
+		case string:
+			links[k] = absoluteURL(base, link)
+		case Link:
+			link.Href = absoluteURL(base, link.Href)
+			links[k] = link
+		default:
+			links[k] = v
+		}
+	}
+	return &links
+}
+
+// absoluteURL prefixes href with base unless href is already absolute.
+func absoluteURL(base, href string) string {
+	u, err := url.Parse(href)
+	if err != nil || u.IsAbs() || u.Host != "" {
+		return href
+	}
+
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(href, "/")
+}
+
+// Link is used to represent a member of the `links` object. The members other
+// than href and meta were added by JSON API 1.1.
+// https://jsonapi.org/format/1.1/#document-links-link-object
 type Link struct {
 	Href string `json:"href"`
 	Meta Meta   `json:"meta,omitempty"`
+
+	Rel   string `json:"rel,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Type is the media type of the link's target
+	Type string `json:"type,omitempty"`
+	// Hreflang is a language tag string, or a []string of them
+	Hreflang interface{} `json:"hreflang,omitempty"`
+	// DescribedBy is a link to a description document, a string or a Link
+	DescribedBy interface{} `json:"describedby,omitempty"`
 }
 
 // Linkable is used to include document links in response data
@@ -97,6 +263,13 @@ type Linkable interface {
 	JSONAPILinks() *Links
 }
 
+// AttributeLinker is used to include action links within a resource's
+// attributes, e.g. {"_links": {"publish": "/posts/1/publish"}}, see
+// WithAttributeLinks.
+type AttributeLinker interface {
+	JSONAPIAttributeLinks() map[string]string
+}
+
 // RelationshipLinkable is used to include relationship links  in response data
 // e.g. {"related": "http://example.com/posts/1/comments"}
 type RelationshipLinkable interface {
@@ -104,6 +277,129 @@ type RelationshipLinkable interface {
 	JSONAPIRelationshipLinks(relation string) *Links
 }
 
+// RelationshipElementFilter is used to leave members of a to-many relationship
+// out of both its linkage and "included", e.g. soft-deleted or hidden ones,
+// without filtering the models' slice beforehand.
+type RelationshipElementFilter interface {
+	// JSONAPIIncludeRelationElement will be invoked for each related model of
+	// the relation (e.g. `comments`), which is kept when it returns true
+	JSONAPIIncludeRelationElement(relation string, element interface{}) bool
+}
+
+// LinkageMetaProvider is implemented by a related model to attach meta to its
+// resource identifier within relationship linkage, rather than to the resource
+// itself e.g. {"type": "users", "id": "1", "meta": {"role": "admin"}}
+type LinkageMetaProvider interface {
+	JSONAPILinkageMeta() *Meta
+}
+
+// RelationshipMetaUnmarshaler is implemented by a model to read back the meta
+// of its relationships on unmarshal, e.g. an attribute of the join table sent
+// along with the linkage. It is invoked only for relationships carrying meta.
+type RelationshipMetaUnmarshaler interface {
+	SetJSONAPIRelationshipMeta(relation string, meta *Meta)
+}
+
+// LinkageMetaSettable is implemented by a related model to read back the meta
+// of its resource identifier within relationship linkage on unmarshal, the
+// counterpart of LinkageMetaProvider.
+type LinkageMetaSettable interface {
+	SetJSONAPILinkageMeta(*Meta)
+}
+
+// JSONAPIEnum is implemented by enum attribute types to choose their wire
+// representation, e.g. "active" or 1
+type JSONAPIEnum interface {
+	JSONAPIEnumValue() interface{}
+}
+
+// JSONAPIEnumScanner is implemented by enum attribute types to parse the wire
+// value back; it is given the decoded JSON value, so it can accept either the
+// code or the label form
+type JSONAPIEnumScanner interface {
+	JSONAPIEnumScan(interface{}) error
+}
+
+// AttrMarshaler is implemented by attribute types that choose their own wire
+// representation whatever their Go one, e.g. a money amount emitted as
+// {"amount": "9.99", "currency": "EUR"}. It takes precedence over JSONAPIEnum.
+type AttrMarshaler interface {
+	MarshalJSONAPIAttribute() (interface{}, error)
+}
+
+// AttrUnmarshaler is implemented by attribute types to parse the wire value
+// back; it is given the decoded JSON value, e.g. a map[string]interface{}
+type AttrUnmarshaler interface {
+	UnmarshalJSONAPIAttribute(interface{}) error
+}
+
+// IDParser is implemented by opaque primary id types, e.g. a struct holding a
+// decrypted cursor, to parse the resource id. Such types marshal through
+// fmt.Stringer, and may implement encoding.TextUnmarshaler instead.
+type IDParser interface {
+	ParseID(string) error
+}
+
+// IDMarshaler is implemented by primary id types, e.g. a UUID, to choose their
+// string representation. It takes precedence over the built-in handling of
+// strings, numbers and fmt.Stringer ids.
+type IDMarshaler interface {
+	JSONAPIID() (string, error)
+}
+
+// IDUnmarshaler is implemented by primary id types to parse the resource id,
+// the counterpart of IDMarshaler. It takes precedence over IDParser.
+type IDUnmarshaler interface {
+	SetJSONAPIID(string) error
+}
+
+// AfterUnmarshaler is implemented by models that derive or normalize fields
+// once they have been populated, e.g. computing a slug. It is called on every
+// unmarshaled model, related ones included, and an error aborts the unmarshal.
+type AfterUnmarshaler interface {
+	AfterUnmarshalJSONAPI() error
+}
+
+// IDComposite is implemented by models whose primary id is built from several
+// fields, e.g. "tenant:widget:42". When implemented it is used in place of the
+// primary field in both directions.
+type IDComposite interface {
+	JSONAPISetID(string) error
+	JSONAPIID() (string, error)
+}
+
+// IDGenerator is implemented by models whose id is assigned lazily, e.g.
+// ephemeral resources, to provide one on marshal while their primary field is
+// empty. The field itself is left untouched.
+type IDGenerator interface {
+	JSONAPIGenerateID() string
+}
+
+// RelationshipProvider is used to include relationships that are not backed by
+// a struct field, e.g. a derived `recommended` list. The returned map is merged
+// into the node's relationships after the tagged ones; its values should be
+// *RelationshipOneNode or *RelationshipManyNode.
+type RelationshipProvider interface {
+	// JSONAPIComputedRelationships is given the included map and sideload flag
+	// of the current marshal so that related nodes can be sideloaded too
+	JSONAPIComputedRelationships(included *map[string]*Node, sideload bool) map[string]interface{}
+}
+
+// FieldsExposer is used by a model to declare the only attributes and
+// relationships that may be emitted for it, regardless of the call site
+// e.g. []string{"title", "posts"}
+type FieldsExposer interface {
+	JSONAPIExposedFields() []string
+}
+
+// FieldVisibilityByContext is used by a model whose visible attributes and
+// relationships depend on the request, e.g. on the authenticated user's role.
+// The context is the one given to MarshalPayloadContext, or
+// context.Background() for the other marshal functions.
+type FieldVisibilityByContext interface {
+	JSONAPIVisibleFields(ctx context.Context) (attrs, rels []string)
+}
+
 // Meta is used to represent a `meta` object.
 // http://jsonapi.org/format/#document-meta
 type Meta map[string]interface{}
@@ -114,6 +410,20 @@ type Metable interface {
 	JSONAPIMeta() *Meta
 }
 
+// ComputedMetable is used to include resource meta computed for the request,
+// e.g. from the authenticated user in the context given to
+// MarshalPayloadContext. It takes precedence over Metable on conflicting keys.
+type ComputedMetable interface {
+	JSONAPIComputedMeta(ctx context.Context) *Meta
+}
+
+// TopLevelMetable is used to include the document meta of a single resource
+// response, e.g. {"request-id": "abc"}, apart from the resource's own meta
+// given by Metable.
+type TopLevelMetable interface {
+	JSONAPITopLevelMeta() *Meta
+}
+
 // RelationshipMetable is used to include relationship meta in response data
 type RelationshipMetable interface {
 	// JSONRelationshipMeta will be invoked for each relationship with the corresponding relation name (e.g. `comments`)
@@ -133,6 +443,10 @@ func (n *Node) merge(node *Node) {
 		n.ClientID = node.ClientID
 	}
 
+	if node.LocalID != "" {
+		n.LocalID = node.LocalID
+	}
+
 	if n.Attributes == nil && node.Attributes != nil {
 		n.Attributes = make(map[string]interface{})
 	}
@@ -151,3 +465,63 @@ func (n *Node) merge(node *Node) {
 		n.Links = node.Links
 	}
 }
+
+// retain drops every attribute and relationship whose name is not in fields.
+func (n *Node) retain(fields map[string]bool) {
+	for k := range n.Attributes {
+		if !fields[k] {
+			delete(n.Attributes, k)
+		}
+	}
+
+	for k := range n.Relationships {
+		if !fields[k] {
+			delete(n.Relationships, k)
+		}
+	}
+}
+
+// prefixAttributes prepends prefix to every top-level attribute key.
+func (n *Node) prefixAttributes(prefix string) {
+	if len(n.Attributes) == 0 {
+		return
+	}
+
+	attrs := make(map[string]interface{}, len(n.Attributes))
+	for k, v := range n.Attributes {
+		attrs[prefix+k] = v
+	}
+	n.Attributes = attrs
+}
+
+// setAttribute stores v under the attribute path, creating intermediate
+// objects for nested paths, e.g. ["address", "city"].
+func (n *Node) setAttribute(path []string, v interface{}) {
+	attrs := n.Attributes
+	for _, key := range path[:len(path)-1] {
+		nested, ok := attrs[key].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			attrs[key] = nested
+		}
+		attrs = nested
+	}
+
+	attrs[path[len(path)-1]] = v
+}
+
+// attribute returns the value stored under the attribute path, and whether it
+// is present at all so that a null value can be told apart from a missing one.
+func (n *Node) attribute(path []string) (interface{}, bool) {
+	var v interface{} = n.Attributes
+	for _, key := range path {
+		attrs, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = attrs[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
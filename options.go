@@ -0,0 +1,456 @@
+package jsonapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupportedClientIDMember is returned by the marshal and unmarshal
+// functions when WithClientIDMember names a member other than "client-id" or
+// LocalIDMember.
+var ErrUnsupportedClientIDMember = errors.New("unsupported client id member")
+
+// Option configures how a payload is marshaled or unmarshaled. Options that
+// only make sense in one direction are ignored by the other.
+type Option func(*options)
+
+type options struct {
+	rejectDuplicateIncluded bool
+	singleAsMany            bool
+	caseInsensitiveTypes    bool
+	allowNullData           bool
+	idAsClientID            bool
+	lenientISO8601          bool
+	reuseRelationSlices     bool
+	types                   *TypeRegistry
+
+	lenientRelationshipTypes bool
+	attributeKeyPrefix       string
+	promoteEmbedded          bool
+	attributeLinksKey        string
+
+	ctx         context.Context
+	baseURL     string
+	canonical   bool
+	paginators  map[string]Paginator
+	includes    map[string]bool
+	typeAliases map[string]string
+	fieldsets   map[string]map[string]bool
+	localID     bool
+	version     string
+
+	resourceMeta func(model interface{}) *Meta
+
+	extraRelationships     map[string]interface{}
+	omitEmptyRelationships bool
+	sortedLinkage          bool
+
+	limitIncludeDepth bool
+	maxIncludeDepth   int
+
+	limitIncludedCount bool
+	maxIncludedCount   int
+
+	limitDepth bool
+	maxDepth   int
+
+	// visiting holds the keys of the resources being marshaled, it is state
+	// of a single marshal call
+	visiting map[resourceKey]bool
+
+	// resolving holds the included keys of the resources being unmarshaled,
+	// it is state of a single unmarshal call, as is hookPanicked, set once
+	// an AfterUnmarshaler hook panics
+	resolving    map[resourceKey]bool
+	hookPanicked bool
+
+	// err is the first invalid option, returned by the call it was passed to
+	err error
+}
+
+// resourceKey identifies a resource by its type and id, cheaper to build and
+// compare than a formatted string.
+type resourceKey struct {
+	typ, id string
+}
+
+// appendOption returns a new slice of opts followed by opt, leaving the
+// caller's backing array alone even when it has spare capacity.
+func appendOption(opts []Option, opt Option) []Option {
+	return append(append(make([]Option, 0, len(opts)+1), opts...), opt)
+}
+
+func newOptions(opts []Option) *options {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRejectDuplicateIncluded makes the unmarshal functions return an error
+// when the "included" array holds two different resources with the same type
+// and id. By default the last occurrence wins.
+func WithRejectDuplicateIncluded() Option {
+	return func(o *options) {
+		o.rejectDuplicateIncluded = true
+	}
+}
+
+// WithPreallocatedRelations makes the unmarshal functions decode to-many
+// relationships into the backing array of a field's slice when it already has
+// capacity, e.g. make([]*Comment, 0, n), rather than allocating a new slice.
+// The caller must not alias that array elsewhere, as it is overwritten.
+func WithPreallocatedRelations() Option {
+	return func(o *options) {
+		o.reuseRelationSlices = true
+	}
+}
+
+// WithSingleResourceAsMany makes UnmarshalManyPayload accept a document whose
+// "data" is a single resource object, treating it as a one element
+// collection. This smooths over servers that inconsistently return an object
+// or an array from collection endpoints.
+func WithSingleResourceAsMany() Option {
+	return func(o *options) {
+		o.singleAsMany = true
+	}
+}
+
+// WithCaseInsensitiveTypes makes the unmarshal functions compare resource
+// types case-insensitively, both when resolving relationship linkage against
+// the "included" array and when checking a resource against the model's
+// primary type, e.g. "Blogs" matches "blogs". The spec makes types case
+// sensitive, so this is only for interoperating with lax servers.
+func WithCaseInsensitiveTypes() Option {
+	return func(o *options) {
+		o.caseInsensitiveTypes = true
+	}
+}
+
+// WithNullDataAllowed makes UnmarshalPayload accept a document whose primary
+// data is null, leaving the model untouched and returning no error. By default
+// ErrNullData is returned so that a null resource can be told apart from a
+// populated one.
+func WithNullDataAllowed() Option {
+	return func(o *options) {
+		o.allowNullData = true
+	}
+}
+
+// WithLenientISO8601 makes the unmarshal functions accept a numeric unix
+// timestamp for a time attribute tagged "iso8601", e.g. from a producer midway
+// through migrating formats. By default it is rejected with ErrInvalidISO8601.
+func WithLenientISO8601() Option {
+	return func(o *options) {
+		o.lenientISO8601 = true
+	}
+}
+
+// WithTypeRegistry makes the unmarshal functions resolve the members of
+// relationships declared as interfaces, e.g. []interface{} or a to-one
+// Publisher interface, to the Go types registered in r for their resource
+// types. The registered type must implement the field's interface.
+func WithTypeRegistry(r *TypeRegistry) Option {
+	return func(o *options) {
+		o.types = r
+	}
+}
+
+// withContext sets the context handed to FieldVisibilityByContext models, see
+// MarshalPayloadContext.
+func withContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// requestContext returns the context given to MarshalPayloadContext, or
+// context.Background() for the other marshal functions.
+func (o *options) requestContext() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// withResourceMeta sets the function computing the call-time meta of every
+// marshaled resource, see MarshalPayloadWithResourceMeta.
+func withResourceMeta(metaFn func(model interface{}) *Meta) Option {
+	return func(o *options) {
+		o.resourceMeta = metaFn
+	}
+}
+
+// withTypeAliases sets the resource type renames applied to the marshaled
+// payload, see MarshalPayloadWithTypeAliases.
+func withTypeAliases(aliases map[string]string) Option {
+	return func(o *options) {
+		o.typeAliases = aliases
+	}
+}
+
+// withVersion sets the version of the top-level jsonapi object of the
+// marshaled payload, see MarshalPayloadWithVersion.
+func withVersion(version string) Option {
+	return func(o *options) {
+		o.version = version
+	}
+}
+
+// withExtraRelationships sets the relationships merged into the marshaled
+// resource, see MarshalPayloadWithExtraRelationships.
+func withExtraRelationships(relationships map[string]interface{}) Option {
+	return func(o *options) {
+		o.extraRelationships = relationships
+	}
+}
+
+// withFieldsets sets the sparse fieldsets applied to the marshaled resources,
+// see MarshalPayloadWithFieldsets.
+func withFieldsets(fields map[string][]string) Option {
+	return func(o *options) {
+		o.fieldsets = make(map[string]map[string]bool, len(fields))
+		for typ, names := range fields {
+			o.fieldsets[typ] = make(map[string]bool, len(names))
+			for _, name := range names {
+				o.fieldsets[typ][name] = true
+			}
+		}
+	}
+}
+
+// WithBaseURL makes the marshal functions prefix relative link hrefs, e.g.
+// "/blogs/5", with the given base URL. Resource, relationship and top-level
+// links are all rewritten; absolute hrefs are left untouched.
+func WithBaseURL(base string) Option {
+	return func(o *options) {
+		o.baseURL = base
+	}
+}
+
+// WithAttributeKeyPrefix makes the marshal functions emit every top-level
+// attribute key with the given vendor prefix, e.g. "acme:title" for a field
+// tagged "attr,title", and the unmarshal functions strip it before matching
+// against the tags. Unprefixed keys still match by their literal name.
+func WithAttributeKeyPrefix(prefix string) Option {
+	return func(o *options) {
+		o.attributeKeyPrefix = prefix
+	}
+}
+
+// WithPromotedEmbeddedFields makes the marshal and unmarshal functions promote
+// the attr and relation fields of untagged embedded structs into the outer
+// resource, like encoding/json promotes embedded fields, e.g. a Base struct
+// shared by several models. The embedded struct's primary, client-id and meta
+// fields are ignored, and the outer fields win when names collide. A nil
+// embedded pointer is skipped on marshal and allocated on unmarshal. Unlike
+// the "extends" tag, the embedded struct isn't a resource type of its own.
+func WithPromotedEmbeddedFields() Option {
+	return func(o *options) {
+		o.promoteEmbedded = true
+	}
+}
+
+// WithAttributeLinks makes the marshal functions emit the links of
+// AttributeLinker models within their attributes, under key, or "_links" when
+// key is empty. This is NON-STANDARD, for clients reading action links from
+// the attributes rather than the links objects.
+func WithAttributeLinks(key string) Option {
+	if key == "" {
+		key = "_links"
+	}
+
+	return func(o *options) {
+		o.attributeLinksKey = key
+	}
+}
+
+// WithInlineUnlessIncluded makes MarshalPayload sideload only the
+// relationships named in include, e.g. the names from an "?include=" query,
+// into "included". Every other relationship has its full resource object
+// inlined as its data, as MarshalPayloadWithoutIncluded does.
+//
+// This deviates from normal sideloading and the spec's resource linkage; it
+// exists to migrate clients that read inlined relationships incrementally.
+// Names are matched against the relationship name at every depth.
+func WithInlineUnlessIncluded(include ...string) Option {
+	return func(o *options) {
+		o.includes = make(map[string]bool, len(include))
+		for _, name := range include {
+			o.includes[name] = true
+		}
+	}
+}
+
+// sideloads reports whether the relationship named relName may be sideloaded.
+func (o *options) sideloads(relName string) bool {
+	return o.includes == nil || o.includes[relName]
+}
+
+// WithMaxIncludeDepth makes MarshalPayload sideload related resources into
+// "included" only up to depth relationships away from the primary data. Deeper
+// relationships are still emitted as linkage, but their resources are left
+// out, e.g. at depth 1 a blog's posts are included but not their comments.
+func WithMaxIncludeDepth(depth int) Option {
+	return func(o *options) {
+		o.limitIncludeDepth = true
+		o.maxIncludeDepth = depth
+	}
+}
+
+// WithMaxDepth makes the marshal functions visit related resources only up to
+// depth relationships away from the primary data. Deeper related resources are
+// linked by their resource identifier alone, without visiting their fields, so
+// deep or unbounded object graphs are cut short. Unlike WithMaxIncludeDepth
+// their own relationships are not emitted either.
+func WithMaxDepth(depth int) Option {
+	return func(o *options) {
+		o.limitDepth = true
+		o.maxDepth = depth
+	}
+}
+
+// visitsDepth reports whether resources depth relationships away from the
+// primary data are visited rather than only linked.
+func (o *options) visitsDepth(depth int) bool {
+	return !o.limitDepth || depth <= o.maxDepth
+}
+
+// visitingNode reports whether the resource of n is still being marshaled
+// further up the relationship graph, so n is only its resource identifier.
+func (o *options) visitingNode(n *Node) bool {
+	return o.visiting[resourceKey{n.Type, n.ID}]
+}
+
+// WithMaxIncludedCount makes the marshal functions return ErrIncludedTooLarge
+// when "included" would hold more than n distinct resources, guarding against
+// relationship graphs sideloading far more than intended.
+func WithMaxIncludedCount(n int) Option {
+	return func(o *options) {
+		o.limitIncludedCount = true
+		o.maxIncludedCount = n
+	}
+}
+
+// WithIDAsClientID makes the unmarshal functions also store a resource's "id"
+// in its model's "client-id" tagged field, for clients that send their
+// temporary id there on create and reconcile it once the server has issued
+// the real one. A client id given in the client id member takes precedence.
+func WithIDAsClientID() Option {
+	return func(o *options) {
+		o.idAsClientID = true
+	}
+}
+
+// WithLenientRelationshipTypes makes the unmarshal functions accept
+// relationship linkage whose type isn't the one declared by the related
+// model's primary tag, unmarshaling the resource into the model regardless.
+// By default ErrRelationshipTypeMismatch is returned.
+func WithLenientRelationshipTypes() Option {
+	return func(o *options) {
+		o.lenientRelationshipTypes = true
+	}
+}
+
+// includesDepth reports whether related resources depth relationships away
+// from the primary data may be added to "included".
+func (o *options) includesDepth(depth int) bool {
+	return !o.limitIncludeDepth || depth <= o.maxIncludeDepth
+}
+
+// WithClientIDMember sets the resource member that "client-id" tagged fields
+// are marshaled to and unmarshaled from. member is either "client-id", the
+// default, or LocalIDMember for the JSON API 1.1 "lid"; any other name makes
+// the call return ErrUnsupportedClientIDMember.
+func WithClientIDMember(member string) Option {
+	return func(o *options) {
+		if member != annotationClientID && member != LocalIDMember {
+			if o.err == nil {
+				o.err = fmt.Errorf("%w: %q", ErrUnsupportedClientIDMember, member)
+			}
+			return
+		}
+		o.localID = member == LocalIDMember
+	}
+}
+
+// clientID returns the client generated id of n from the configured member.
+func (o *options) clientID(n *Node) string {
+	if o.localID {
+		return n.LocalID
+	}
+	return n.ClientID
+}
+
+// setClientID stores id in the configured client id member of n.
+func (o *options) setClientID(n *Node, id string) {
+	if o.localID {
+		n.LocalID = id
+	} else {
+		n.ClientID = id
+	}
+}
+
+// WithOmitEmptyRelationships makes the marshal functions leave out every
+// relationship whose related model is nil or whose slice is empty, as if each
+// were tagged "omitempty". A relationship tagged "keep" is still emitted, e.g.
+// as {"data": []}.
+func WithOmitEmptyRelationships() Option {
+	return func(o *options) {
+		o.omitEmptyRelationships = true
+	}
+}
+
+// WithCanonicalOutput makes the marshal functions produce deterministic output,
+// e.g. for golden files and API examples, by sorting the included resources by
+// type and id, numeric ids numerically. Attribute, relationship and meta keys
+// are always sorted, and Node.MarshalJSON always writes resource members in
+// the spec's order of type, id, attributes, relationships, links and meta.
+func WithCanonicalOutput() Option {
+	return func(o *options) {
+		o.canonical = true
+	}
+}
+
+// WithSortedLinkage makes the marshal functions sort the linkage of to-many
+// relationships by type and id rather than keeping the order of the related
+// models, e.g. for clients diffing relationship sets. It is opt-in as the
+// order of some relationships is significant.
+func WithSortedLinkage() Option {
+	return func(o *options) {
+		o.sortedLinkage = true
+	}
+}
+
+// Paginator supplies the pagination details of a to-many relationship, see
+// WithRelationshipPaginator.
+type Paginator interface {
+	// Paginate is given the model owning the relationship and returns the
+	// total number of related resources, the current page number and the
+	// pagination links, keyed by e.g. KeyNextPage.
+	Paginate(model interface{}) (count, page int, links *Links)
+}
+
+// PaginatorFunc is an adapter allowing an ordinary function to be used as a
+// Paginator.
+type PaginatorFunc func(model interface{}) (count, page int, links *Links)
+
+// Paginate calls f(model).
+func (f PaginatorFunc) Paginate(model interface{}) (count, page int, links *Links) {
+	return f(model)
+}
+
+// WithRelationshipPaginator makes the marshal functions fill the "count" and
+// "page" meta and the pagination links of every to-many relationship named
+// relName from p. They are merged over anything supplied by the
+// RelationshipMetable and RelationshipLinkable implementations.
+func WithRelationshipPaginator(relName string, p Paginator) Option {
+	return func(o *options) {
+		if o.paginators == nil {
+			o.paginators = make(map[string]Paginator)
+		}
+		o.paginators[relName] = p
+	}
+}
@@ -0,0 +1,178 @@
+package jsonapi
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ErrUnregisteredType is returned, wrapped with the offending type, when a
+// polymorphic relationship holds a resource whose type isn't in the registry.
+var ErrUnregisteredType = errors.New("resource type is not registered")
+
+// TypeRegistry maps JSON API resource types to the Go types they are
+// unmarshaled into, for relationships declared as interfaces, e.g.
+// []interface{}, whose members may be of several types.
+type TypeRegistry struct {
+	types map[string]reflect.Type
+}
+
+// NewTypeRegistry returns an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: make(map[string]reflect.Type)}
+}
+
+// RegisterType makes resources of type name unmarshal into new instances of
+// proto's type, which must be a struct pointer, e.g. (*Post)(nil).
+func (r *TypeRegistry) RegisterType(name string, proto interface{}) {
+	t := reflect.TypeOf(proto)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("jsonapi: RegisterType of %q needs a struct pointer, got %T", name, proto))
+	}
+
+	r.types[name] = t
+}
+
+// lookup returns the struct pointer type registered for the resource type name.
+func (r *TypeRegistry) lookup(name string, o *options) (reflect.Type, error) {
+	if r != nil {
+		if t, ok := r.types[name]; ok {
+			return t, nil
+		}
+
+		if o.caseInsensitiveTypes {
+			for registered, t := range r.types {
+				if strings.EqualFold(registered, name) {
+					return t, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnregisteredType, name)
+}
+
+// AttributeEncoder returns the wire representation of an attribute value,
+// see RegisterAttributeEncoder.
+type AttributeEncoder func(v reflect.Value) (interface{}, error)
+
+// AttributeDecoder stores the decoded JSON value raw of an attribute in dst,
+// see RegisterAttributeDecoder.
+type AttributeDecoder func(raw interface{}, dst reflect.Value) error
+
+var attributeCodecs = struct {
+	sync.RWMutex
+	encoders map[reflect.Type]AttributeEncoder
+	decoders map[reflect.Type]AttributeDecoder
+}{
+	encoders: make(map[reflect.Type]AttributeEncoder),
+	decoders: make(map[reflect.Type]AttributeDecoder),
+}
+
+// RegisterAttributeEncoder makes every attribute of type t, or pointer to it,
+// marshal to the value returned by fn, e.g. for third party types such as a
+// UUID that can't implement AttrMarshaler. It takes precedence over the
+// interfaces and built-in handling.
+func RegisterAttributeEncoder(t reflect.Type, fn AttributeEncoder) {
+	attributeCodecs.Lock()
+	defer attributeCodecs.Unlock()
+	attributeCodecs.encoders[t] = fn
+}
+
+// RegisterAttributeDecoder makes every attribute of type t, or pointer to it,
+// unmarshal through fn, which is given the decoded JSON value and the field,
+// allocated first for a nil pointer. It takes precedence over the interfaces
+// and built-in handling.
+func RegisterAttributeDecoder(t reflect.Type, fn AttributeDecoder) {
+	attributeCodecs.Lock()
+	defer attributeCodecs.Unlock()
+	attributeCodecs.decoders[t] = fn
+}
+
+// UnregisterAttributeEncoder removes the encoder registered for t, if any, so
+// its attributes marshal as usual again.
+func UnregisterAttributeEncoder(t reflect.Type) {
+	attributeCodecs.Lock()
+	defer attributeCodecs.Unlock()
+	delete(attributeCodecs.encoders, t)
+}
+
+// UnregisterAttributeDecoder removes the decoder registered for t, if any, so
+// its attributes unmarshal as usual again.
+func UnregisterAttributeDecoder(t reflect.Type) {
+	attributeCodecs.Lock()
+	defer attributeCodecs.Unlock()
+	delete(attributeCodecs.decoders, t)
+}
+
+// attributeEncoder returns the encoder registered for the type of field, or
+// of the value it points to, along with the value to encode.
+func attributeEncoder(field reflect.Value) (AttributeEncoder, reflect.Value) {
+	attributeCodecs.RLock()
+	defer attributeCodecs.RUnlock()
+
+	if fn, ok := attributeCodecs.encoders[field.Type()]; ok {
+		return fn, field
+	}
+	if field.Kind() == reflect.Ptr && !field.IsNil() {
+		if fn, ok := attributeCodecs.encoders[field.Type().Elem()]; ok {
+			return fn, field.Elem()
+		}
+	}
+	return nil, field
+}
+
+// attributeDecoder returns the decoder registered for the type of field, or
+// of the value it points to, along with the value to decode into, allocating
+// a nil pointer field.
+func attributeDecoder(field reflect.Value) (AttributeDecoder, reflect.Value) {
+	attributeCodecs.RLock()
+	defer attributeCodecs.RUnlock()
+
+	if fn, ok := attributeCodecs.decoders[field.Type()]; ok {
+		return fn, field
+	}
+	if field.Kind() == reflect.Ptr {
+		if fn, ok := attributeCodecs.decoders[field.Type().Elem()]; ok {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			return fn, field.Elem()
+		}
+	}
+	return nil, field
+}
+
+var typeAttributeHooks = struct {
+	sync.RWMutex
+	hooks map[string]func(attrs map[string]interface{})
+}{
+	hooks: make(map[string]func(attrs map[string]interface{})),
+}
+
+// RegisterTypeAttributeHook makes hook run on the attributes of every node of
+// resourceType once it is built, e.g. to round all the money attributes to 2
+// decimals. The hook may add, change or delete attributes; registering another
+// hook for the same type replaces it.
+func RegisterTypeAttributeHook(resourceType string, hook func(attrs map[string]interface{})) {
+	typeAttributeHooks.Lock()
+	defer typeAttributeHooks.Unlock()
+	typeAttributeHooks.hooks[resourceType] = hook
+}
+
+// UnregisterTypeAttributeHook removes the hook registered for resourceType, if
+// any.
+func UnregisterTypeAttributeHook(resourceType string) {
+	typeAttributeHooks.Lock()
+	defer typeAttributeHooks.Unlock()
+	delete(typeAttributeHooks.hooks, resourceType)
+}
+
+// typeAttributeHook returns the hook registered for resourceType, if any.
+func typeAttributeHook(resourceType string) func(attrs map[string]interface{}) {
+	typeAttributeHooks.RLock()
+	defer typeAttributeHooks.RUnlock()
+	return typeAttributeHooks.hooks[resourceType]
+}
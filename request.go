@@ -1,11 +1,15 @@
 package jsonapi
 
 import (
+	"bufio"
 	"bytes"
+	"encoding"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -23,6 +27,13 @@ var (
 	// ErrInvalidISO8601 is returned when a struct has a time.Time type field and includes
 	// "iso8601" in the tag spec, but the JSON value was not an ISO8601 timestamp string.
 	ErrInvalidISO8601 = errors.New("Only strings can be parsed as dates, ISO8601 timestamps")
+	// ErrInvalidDateOnly is returned when a struct has a time.Time type field and includes
+	// "dateonly" in the tag spec, but the JSON value was not a YYYY-MM-DD date string.
+	ErrInvalidDateOnly = errors.New("Only strings can be parsed as dates, YYYY-MM-DD dates")
+	// ErrInvalidTimeLayout is returned, wrapped with the received value and layout, when
+	// a struct has a time.Time type field with a custom or named layout in the tag spec,
+	// but the JSON value was not a string in that layout.
+	ErrInvalidTimeLayout = errors.New("time does not match the attribute's layout")
 	// ErrUnknownFieldNumberType is returned when the JSON value was a float
 	// (numeric) but the Struct field was a non numeric type (i.e. not int, uint,
 	// float, etc)
@@ -32,6 +43,23 @@ var (
 	ErrUnsupportedPtrType = errors.New("Pointer type in struct is not supported")
 	// ErrInvalidType is returned when the given type is incompatible with the expected type.
 	ErrInvalidType = errors.New("Invalid type provided") // I wish we used punctuation.
+	// ErrDuplicateIncluded is returned, wrapped with the offending type and id,
+	// when WithRejectDuplicateIncluded is set and the "included" array holds two
+	// different resources with the same type and id.
+	ErrDuplicateIncluded = errors.New("conflicting duplicate resource in included")
+	// ErrNullData is returned by UnmarshalPayload when the document's primary data is
+	// null, e.g. {"data": null} for a resource that wasn't found, unless
+	// WithNullDataAllowed is set.
+	ErrNullData = errors.New("primary data is null")
+	// ErrRelationshipTypeMismatch is returned, wrapped with the relationship name
+	// and the expected and received types, when a relationship's linkage type
+	// isn't the one declared by the related model's primary tag, unless
+	// WithLenientRelationshipTypes is set.
+	ErrRelationshipTypeMismatch = errors.New("relationship linkage type mismatch")
+	// ErrInvalidRelationKey is returned, wrapped with the relationship name and
+	// the id, when a relationship decoded into a map holds a resource without
+	// an id or two resources with the same id.
+	ErrInvalidRelationKey = errors.New("relationship linkage id is empty or duplicated")
 )
 
 // UnmarshalPayload converts an io into a struct instance using jsonapi tags on
@@ -67,47 +95,59 @@ var (
 // Visit https://github.com/google/jsonapi#create for more info.
 //
 // model interface{} should be a pointer to a struct.
-func UnmarshalPayload(in io.Reader, model interface{}) error {
+func UnmarshalPayload(in io.Reader, model interface{}, opts ...Option) error {
+	o := newOptions(opts)
+	if o.err != nil {
+		return o.err
+	}
 	payload := new(OnePayload)
 
-	if err := json.NewDecoder(in).Decode(payload); err != nil {
+	if err := json.NewDecoder(skipBOM(in)).Decode(payload); err != nil {
 		return err
 	}
 
+	if payload.Data == nil {
+		if o.allowNullData {
+			return nil
+		}
+		return ErrNullData
+	}
+
 	if payload.Included != nil {
-		includedMap := make(map[string]*Node)
-		for _, included := range payload.Included {
-			key := fmt.Sprintf("%s,%s", included.Type, included.ID)
-			includedMap[key] = included
+		includedMap, err := buildIncludedMap(payload.Included, o)
+		if err != nil {
+			return err
 		}
 
-		return unmarshalNode(payload.Data, reflect.ValueOf(model), &includedMap)
+		return unmarshalNode(payload.Data, reflect.ValueOf(model), &includedMap, o)
 	}
-	return unmarshalNode(payload.Data, reflect.ValueOf(model), nil)
+	return unmarshalNode(payload.Data, reflect.ValueOf(model), nil, o)
 }
 
 // UnmarshalManyPayload converts an io into a set of struct instances using
 // jsonapi tags on the type's struct fields.
-func UnmarshalManyPayload(in io.Reader, t reflect.Type) ([]interface{}, error) {
-	payload := new(ManyPayload)
+func UnmarshalManyPayload(in io.Reader, t reflect.Type, opts ...Option) ([]interface{}, error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
 
-	if err := json.NewDecoder(in).Decode(payload); err != nil {
+	payload, err := decodeManyPayload(in, o)
+	if err != nil {
 		return nil, err
 	}
 
-	models := []interface{}{}         // will be populated from the "data"
-	includedMap := map[string]*Node{} // will be populate from the "included"
+	models := []interface{}{} // will be populated from the "data"
 
-	if payload.Included != nil {
-		for _, included := range payload.Included {
-			key := fmt.Sprintf("%s,%s", included.Type, included.ID)
-			includedMap[key] = included
-		}
+	// will be populated from the "included"
+	includedMap, err := buildIncludedMap(payload.Included, o)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, data := range payload.Data {
 		model := reflect.New(t.Elem())
-		err := unmarshalNode(data, model, &includedMap)
+		err := unmarshalNode(data, model, &includedMap, o)
 		if err != nil {
 			return nil, err
 		}
@@ -117,31 +157,312 @@ func UnmarshalManyPayload(in io.Reader, t reflect.Type) ([]interface{}, error) {
 	return models, nil
 }
 
+// UnmarshalManyPayloadInto converts an io into the slice of struct pointers
+// out points to, e.g. a *[]*Blog, like encoding/json decodes into a typed
+// slice. ErrUnexpectedType is returned when out is anything else.
+func UnmarshalManyPayloadInto(in io.Reader, out interface{}, opts ...Option) error {
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return ErrUnexpectedType
+	}
+
+	sliceType := ptr.Type().Elem()
+	if sliceType.Kind() != reflect.Slice ||
+		sliceType.Elem().Kind() != reflect.Ptr ||
+		sliceType.Elem().Elem().Kind() != reflect.Struct {
+		return ErrUnexpectedType
+	}
+
+	models, err := UnmarshalManyPayload(in, sliceType.Elem(), opts...)
+	if err != nil {
+		return err
+	}
+
+	values := reflect.MakeSlice(sliceType, len(models), len(models))
+	for i, model := range models {
+		values.Index(i).Set(reflect.ValueOf(model))
+	}
+	ptr.Elem().Set(values)
+	return nil
+}
+
+// PayloadKind is the shape of a JSON API document, as reported by Probe.
+type PayloadKind int
+
+const (
+	// PayloadKindUnknown is a document with neither "data" nor "errors", e.g.
+	// a meta only document.
+	PayloadKindUnknown PayloadKind = iota
+	// PayloadKindOne is a document whose "data" is a single resource or null,
+	// to be read with UnmarshalPayload.
+	PayloadKindOne
+	// PayloadKindMany is a document whose "data" is an array, to be read with
+	// UnmarshalManyPayload.
+	PayloadKindMany
+	// PayloadKindErrors is an errors document.
+	PayloadKindErrors
+)
+
+// Probe peeks at the top-level members of the document read from in and
+// reports its kind. The returned reader replays the whole document, so it can
+// be handed to the matching Unmarshal function.
+func Probe(in io.Reader) (PayloadKind, io.Reader, error) {
+	body, err := ioutil.ReadAll(in)
+	if err != nil {
+		return PayloadKindUnknown, nil, err
+	}
+	replay := bytes.NewReader(body)
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(body, &document); err != nil {
+		return PayloadKindUnknown, replay, err
+	}
+
+	if _, ok := document["errors"]; ok {
+		return PayloadKindErrors, replay, nil
+	}
+
+	data, ok := document["data"]
+	if !ok {
+		return PayloadKindUnknown, replay, nil
+	}
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		return PayloadKindMany, replay, nil
+	}
+
+	return PayloadKindOne, replay, nil
+}
+
+// RelationshipIterator returns a sequence of the models related to node by
+// its to-many relationship relName, decoded one at a time as the sequence is
+// iterated rather than materialized into a slice, e.g. to process a very
+// large relationship in bounded memory. Each model is a new instance of
+// proto's type, a struct pointer such as (*Comment)(nil), filled from the
+// matching resource of included when there is one. A missing relationship
+// yields nothing.
+//
+// The sequence has the shape of iter.Seq2[interface{}, error], so it can be
+// ranged over with Go 1.23 or later:
+//
+//	for comment, err := range seq {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func RelationshipIterator(node *Node, relName string, proto interface{},
+	included []*Node, opts ...Option) (func(yield func(interface{}, error) bool), error) {
+	t := reflect.TypeOf(proto)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, ErrUnexpectedType
+	}
+
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+	includedMap, err := buildIncludedMap(included, o)
+	if err != nil {
+		return nil, err
+	}
+
+	relationship := new(RelationshipManyNode)
+	if node != nil && node.Relationships[relName] != nil {
+		buf, err := json.Marshal(node.Relationships[relName])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf, relationship); err != nil {
+			return nil, err
+		}
+	}
+
+	// Members are resolved like those of a relationship field, checking their
+	// type and only linking back to node, which is being unmarshaled
+	nb := nodeBuilder{node: node, args: []string{annotationRelation, relName}, opts: o}
+	if node != nil {
+		o.resolving = map[resourceKey]bool{resolvingKey(node, o): true}
+	}
+
+	return func(yield func(interface{}, error) bool) {
+		for _, n := range relationship.Data {
+			model := reflect.New(t.Elem())
+			related, err := nb.relatedNode(n, t, &includedMap)
+			if err == nil {
+				err = unmarshalNode(related, model, &includedMap, o)
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			setLinkageMeta(model, n)
+
+			if !yield(model.Interface(), nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// DocumentVersion reads the document from in and returns the JSON API version
+// declared by its top-level `jsonapi` object. Per the spec a document without
+// one is taken to be version 1.0.
+func DocumentVersion(in io.Reader) (string, error) {
+	document := new(struct {
+		JSONAPI *JSONAPIObject `json:"jsonapi"`
+	})
+	if err := json.NewDecoder(in).Decode(document); err != nil {
+		return "", err
+	}
+
+	if document.JSONAPI == nil || document.JSONAPI.Version == "" {
+		return defaultJSONAPIVersion, nil
+	}
+
+	return document.JSONAPI.Version, nil
+}
+
+// skipBOM returns a reader of in past any leading UTF-8 byte order marks and
+// whitespace, which some non-Go clients prepend to request bodies and
+// encoding/json rejects.
+func skipBOM(in io.Reader) io.Reader {
+	r := bufio.NewReader(in)
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return r
+		}
+
+		switch c {
+		case '\uFEFF', ' ', '\t', '\n', '\r':
+		default:
+			r.UnreadRune()
+			return r
+		}
+	}
+}
+
+// decodeManyPayload decodes a collection document, wrapping a single resource
+// "data" object into a one element collection when the option allows it.
+func decodeManyPayload(in io.Reader, o *options) (*ManyPayload, error) {
+	payload := new(ManyPayload)
+	in = skipBOM(in)
+
+	if !o.singleAsMany {
+		if err := json.NewDecoder(in).Decode(payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(in).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	err := json.Unmarshal(raw, payload)
+	if err == nil {
+		return payload, nil
+	}
+
+	one := new(OnePayload)
+	if json.Unmarshal(raw, one) != nil {
+		return nil, err
+	}
+
+	payload = &ManyPayload{
+		Data:     []*Node{},
+		Included: one.Included,
+		Links:    one.Links,
+		Meta:     one.Meta,
+		JSONAPI:  one.JSONAPI,
+	}
+	if one.Data != nil {
+		payload.Data = append(payload.Data, one.Data)
+	}
+	return payload, nil
+}
+
+// buildIncludedMap keys the "included" resources by type and id so that
+// relationship linkage can be resolved against them.
+func buildIncludedMap(included []*Node, o *options) (map[string]*Node, error) {
+	includedMap := make(map[string]*Node)
+
+	for _, n := range included {
+		key := includedKey(n, o)
+
+		if existing, ok := includedMap[key]; ok && o.rejectDuplicateIncluded &&
+			!reflect.DeepEqual(existing, n) {
+			return nil, fmt.Errorf("%w: (%s,%s)", ErrDuplicateIncluded, n.Type, n.ID)
+		}
+
+		includedMap[key] = n
+	}
+
+	return includedMap, nil
+}
+
+// AttributeError is returned when an attribute's value doesn't fit its field,
+// identifying both by name. Err holds the underlying ErrInvalidType or
+// ErrUnknownFieldNumberType.
+type AttributeError struct {
+	Attribute string
+	Field     string
+	Expected  string
+	Got       string
+	Err       error
+}
+
+// Error implements the `error` interface.
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("invalid type for attribute %q (field %s): expected %s, got %s",
+		e.Attribute, e.Field, e.Expected, e.Got)
+}
+
+// Unwrap returns the underlying error so it can be matched with errors.Is.
+func (e *AttributeError) Unwrap() error {
+	return e.Err
+}
+
 type nodeBuilder struct {
 	node       *Node
 	args       []string
+	modelValue reflect.Value
 	fieldValue reflect.Value
 	fieldType  reflect.StructField
+	opts       *options
 }
 
-func unmarshalNode(node *Node, model reflect.Value, included *map[string]*Node) (err error) {
+func unmarshalNode(node *Node, model reflect.Value, included *map[string]*Node, o *options) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
+			// A panic in the model's own hook is a bug of the caller's,
+			// re-raised as is rather than mistaken for bad data
+			if o.hookPanicked {
+				panic(r)
+			}
 			err = fmt.Errorf("data is not a jsonapi representation of '%v'", model.Type())
 		}
 	}()
 
-	modelValue := model.Elem()
-	modelType := model.Type().Elem()
-
-	for i := 0; i < modelValue.NumField(); i++ {
-		fieldType := modelType.Field(i)
-		tag := fieldType.Tag.Get("jsonapi")
-		if tag == "" {
-			continue
+	// Track the resources being unmarshaled so that a relationship cycle
+	// through included is cut short, see relatedNode
+	if node.ID != "" {
+		key := resolvingKey(node, o)
+		if !o.resolving[key] {
+			if o.resolving == nil {
+				o.resolving = make(map[resourceKey]bool)
+			}
+			o.resolving[key] = true
+			defer delete(o.resolving, key)
 		}
+	}
+
+	modelValue := model.Elem()
 
-		args := strings.Split(tag, ",")
+	for _, field := range modelFields(modelValue, o.promoteEmbedded, true) {
+		fieldType := field.structField
+		args := field.args
 
 		if len(args) < 1 {
 			return ErrBadJSONAPIStructTag
@@ -150,12 +471,14 @@ func unmarshalNode(node *Node, model reflect.Value, included *map[string]*Node)
 		nb := nodeBuilder{
 			node:       node,
 			args:       args,
-			fieldValue: modelValue.Field(i),
+			modelValue: modelValue,
+			fieldValue: field.value,
 			fieldType:  fieldType,
+			opts:       o,
 		}
 
 		if (nb.args[0] == annotationClientID && len(args) != 1) ||
-			(nb.args[0] != annotationClientID && len(args) < 2) {
+			(nb.args[0] != annotationClientID && nb.args[0] != annotationMeta && len(args) < 2) {
 			return ErrBadJSONAPIStructTag
 		}
 
@@ -165,16 +488,24 @@ func unmarshalNode(node *Node, model reflect.Value, included *map[string]*Node)
 				return err
 			}
 		case annotationClientID:
-			if nb.node.ClientID == "" {
+			clientID := nb.opts.clientID(nb.node)
+			if clientID == "" && nb.opts.idAsClientID {
+				clientID = nb.node.ID
+			}
+			if clientID == "" {
 				continue
 			}
-			nb.fieldValue.Set(reflect.ValueOf(nb.node.ClientID))
+			nb.fieldValue.Set(reflect.ValueOf(clientID))
 		case annotationAttribute:
 			if err := nb.doAttribute(); err != nil {
 				return err
 			}
 		case annotationExtends:
-			if err := nb.doExtends(); err != nil {
+			if err := nb.doExtends(included); err != nil {
+				return err
+			}
+		case annotationMeta:
+			if err := nb.doMeta(); err != nil {
 				return err
 			}
 		case annotationRelation:
@@ -186,21 +517,43 @@ func unmarshalNode(node *Node, model reflect.Value, included *map[string]*Node)
 		}
 	}
 
+	if hook, ok := model.Interface().(AfterUnmarshaler); ok {
+		return afterUnmarshal(hook, o)
+	}
+
 	return nil
 }
 
+// afterUnmarshal runs the hook, flagging a panic in it so that unmarshalNode
+// lets it through along with its stack.
+func afterUnmarshal(hook AfterUnmarshaler, o *options) error {
+	defer func() {
+		if r := recover(); r != nil {
+			o.hookPanicked = true
+			panic(r)
+		}
+	}()
+
+	return hook.AfterUnmarshalJSONAPI()
+}
+
 func (nb nodeBuilder) doPrimary() error {
+	// Check the JSON API Type, also of resources being created without an id
+	if err := nb.checkType(); err != nil {
+		return err
+	}
+
 	if nb.node.ID == "" {
 		return nil
 	}
 
-	// Check the JSON API Type
-	if nb.node.Type != nb.args[1] {
-		return fmt.Errorf(
-			"Trying to Unmarshal an object of type %#v, but %#v does not match",
-			nb.node.Type,
-			nb.args[1],
-		)
+	if composite, ok := nb.modelValue.Addr().Interface().(IDComposite); ok {
+		return composite.JSONAPISetID(nb.node.ID)
+	}
+
+	unmarshaler := implementation(nb.fieldValue, reflect.TypeOf((*IDUnmarshaler)(nil)).Elem())
+	if unmarshaler != nil {
+		return unmarshaler.(IDUnmarshaler).SetJSONAPIID(nb.node.ID)
 	}
 
 	// ID will have to be transmitted as astring per the JSON API spec
@@ -220,6 +573,11 @@ func (nb nodeBuilder) doPrimary() error {
 		return nil
 	}
 
+	// Opaque ids, e.g. an encrypted token, parse themselves
+	if kind == reflect.Struct {
+		return nb.parseOpaqueID()
+	}
+
 	// Value was not a string... only other supported type was a numeric,
 	// which would have been sent as a float value.
 	floatValue, err := strconv.ParseFloat(nb.node.ID, 64)
@@ -272,160 +630,393 @@ func (nb nodeBuilder) doPrimary() error {
 	return nil
 }
 
-func (nb nodeBuilder) doExtends() error {
-	m := reflect.New(nb.fieldValue.Type().Elem())
-	embedded := m.Interface()
+// parseOpaqueID sets a struct primary field through its IDParser or
+// encoding.TextUnmarshaler implementation.
+func (nb nodeBuilder) parseOpaqueID() error {
+	parser := implementation(nb.fieldValue, reflect.TypeOf((*IDParser)(nil)).Elem())
+	if parser != nil {
+		return parser.(IDParser).ParseID(nb.node.ID)
+	}
 
-	newNodeAttr := make(map[string]interface{})
-	for k, v := range nb.node.Attributes {
-		newNodeAttr[k] = v
+	unmarshaler := implementation(nb.fieldValue, reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem())
+	if unmarshaler != nil {
+		return unmarshaler.(encoding.TextUnmarshaler).UnmarshalText([]byte(nb.node.ID))
 	}
 
-	var val reflect.Value
-	if nb.fieldValue.Kind() == reflect.Ptr {
-		val = reflect.Indirect(nb.fieldValue)
-	} else {
-		val = nb.fieldValue.Elem()
+	return ErrBadJSONAPIID
+}
+
+// checkType returns an error if the node isn't of the type named by the tag. A
+// node with neither a type nor an id, e.g. {"data": {}}, is let through.
+func (nb nodeBuilder) checkType() error {
+	if nb.node.Type == "" && nb.node.ID == "" {
+		return nil
 	}
 
-	if !val.IsValid() {
+	if nb.node.Type != nb.args[1] &&
+		!(nb.opts.caseInsensitiveTypes && strings.EqualFold(nb.node.Type, nb.args[1])) {
+		return fmt.Errorf(
+			"Trying to Unmarshal an object of type %#v, but %#v does not match",
+			nb.node.Type,
+			nb.args[1],
+		)
+	}
+
+	return nil
+}
+
+func (nb nodeBuilder) doExtends(included *map[string]*Node) error {
+	// The extends tag names the type of the model as a whole, which may have
+	// no primary field of its own
+	if err := nb.checkType(); err != nil {
+		return err
+	}
+
+	target := nb.fieldValue
+	switch target.Kind() {
+	case reflect.Ptr:
+		if target.Type().Elem().Kind() != reflect.Struct {
+			return ErrInvalidType
+		}
+		// Allocate the embedded struct so callers need not pre-initialize it
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+	case reflect.Struct:
+		target = target.Addr()
+	default:
 		return ErrInvalidType
 	}
 
-	for i := 0; i < reflect.TypeOf(val).NumField(); i++ {
-		typeField := val.Type().Field(i)
-		tag := typeField.Tag.Get("jsonapi")
+	// The embedded struct carries its own primary type, the node is decoded
+	// into it as if it were of that type
+	embeddedNode := *nb.node
+	if primaryType := embeddedPrimaryType(target.Type().Elem()); primaryType != "" {
+		embeddedNode.Type = primaryType
+	}
+
+	return unmarshalNode(&embeddedNode, target, included, nb.opts)
+}
+
+// parseTime parses a time attribute value per the field's time format, a unix
+// timestamp unless one of the format tag arguments is set.
+func parseTime(v reflect.Value, layout string, iso8601, dateOnly, lenient bool) (time.Time, error) {
+	if layout != "" {
+		return parseTimeLayout(v, layout)
+	}
+
+	if dateOnly {
+		return parseDateOnly(v)
+	}
 
-		if tag == "" {
-			continue
+	// A lenient parse falls back to a unix timestamp for a numeric value
+	if iso8601 && !(lenient && v.Kind() == reflect.Float64) {
+		if v.Kind() != reflect.String {
+			return time.Time{}, ErrInvalidISO8601
 		}
 
-		args := strings.Split(tag, ",")
-		if args[0] == annotationPrimary {
-			newNodeAttr[typeField.Name] = nb.node.ID
+		t, err := time.Parse(iso8601TimeFormat, v.String())
+		if err != nil {
+			return time.Time{}, ErrInvalidISO8601
 		}
+
+		return t, nil
 	}
 
-	in := bytes.NewBuffer(nil)
-	if err := json.NewEncoder(in).Encode(newNodeAttr); err != nil {
-		return nil
+	var at int64
+
+	if v.Kind() == reflect.Float64 {
+		at = int64(v.Interface().(float64))
+	} else if v.Kind() == reflect.Int {
+		at = v.Int()
+	} else {
+		return time.Time{}, ErrInvalidTime
+	}
+
+	return time.Unix(at, 0), nil
+}
+
+// setTime stores t in field, a time or time pointer as accepted by isTime and
+// isTimePtr, converting it to the field's named time type if need be.
+func setTime(field reflect.Value, t time.Time) {
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		ptr.Elem().Set(reflect.ValueOf(t).Convert(ptr.Elem().Type()))
+		field.Set(ptr)
+		return
+	}
+
+	field.Set(reflect.ValueOf(t).Convert(field.Type()))
+}
+
+// parseDateOnly parses a "dateonly" attribute value, a YYYY-MM-DD string, into
+// midnight UTC of that date.
+func parseDateOnly(v reflect.Value) (time.Time, error) {
+	if v.Kind() != reflect.String {
+		return time.Time{}, ErrInvalidDateOnly
 	}
 
-	if err := json.NewDecoder(in).Decode(embedded); err != nil {
+	t, err := time.Parse(dateOnlyFormat, v.String())
+	if err != nil {
+		return time.Time{}, ErrInvalidDateOnly
+	}
+
+	return t, nil
+}
+
+// parseTimeLayout parses an attribute value in a custom or named layout.
+func parseTimeLayout(v reflect.Value, layout string) (time.Time, error) {
+	if v.Kind() != reflect.String {
+		return time.Time{}, fmt.Errorf("%w: %v is not a string in layout %q",
+			ErrInvalidTimeLayout, v.Interface(), layout)
+	}
+
+	t, err := time.Parse(layout, v.String())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q does not match layout %q",
+			ErrInvalidTimeLayout, v.String(), layout)
+	}
+
+	return t, nil
+}
+
+// embeddedPrimaryType returns the type declared by the primary tag of t, or
+// an empty string if t has none.
+func embeddedPrimaryType(t reflect.Type) string {
+	for i := 0; i < t.NumField(); i++ {
+		args := strings.Split(t.Field(i).Tag.Get("jsonapi"), ",")
+		if len(args) > 1 && args[0] == annotationPrimary {
+			return args[1]
+		}
+	}
+
+	return ""
+}
+
+func (nb nodeBuilder) doMeta() error {
+	// readonly meta is server computed, clients may not set it
+	if len(nb.args) > 2 {
+		for _, arg := range nb.args[2:] {
+			if arg == annotationReadOnly {
+				return nil
+			}
+		}
+	}
+
+	if nb.node.Meta == nil {
 		return nil
 	}
 
-	nb.fieldValue.Set(reflect.ValueOf(embedded))
+	// A bare "meta" tag holds the whole meta object
+	var val interface{} = *nb.node.Meta
+	if len(nb.args) > 1 {
+		var ok bool
+		if val, ok = (*nb.node.Meta)[nb.args[1]]; !ok || val == nil {
+			return nil
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(buf).Encode(val); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(buf).Decode(nb.fieldValue.Addr().Interface()); err != nil {
+		return ErrInvalidType
+	}
+
 	return nil
 }
 
-func (nb nodeBuilder) doAttribute() error {
+func (nb nodeBuilder) doAttribute() (err error) {
 	attributes := nb.node.Attributes
 	if attributes == nil || len(nb.node.Attributes) == 0 {
 		return nil
 	}
 
-	var iso8601 bool
+	var iso8601, dateOnly bool
+	path := []string{nb.args[1]}
+	layout := timeLayout(nb.args[2:])
 
 	if len(nb.args) > 2 {
 		for _, arg := range nb.args[2:] {
-			if arg == annotationISO8601 {
+			switch arg {
+			case annotationISO8601:
 				iso8601 = true
+			case annotationDateOnly:
+				dateOnly = true
+			case annotationNested:
+				path = strings.Split(nb.args[1], annotationPathSeparator)
 			}
 		}
 	}
 
-	val := attributes[nb.args[1]]
+	val, present := nb.attribute(path)
+	defer func() {
+		if errors.Is(err, ErrInvalidType) || errors.Is(err, ErrUnknownFieldNumberType) {
+			err = &AttributeError{
+				Attribute: nb.args[1],
+				Field:     nb.modelValue.Type().Name() + "." + nb.fieldType.Name,
+				Expected:  nb.fieldType.Type.String(),
+				Got:       fmt.Sprintf("%T", val),
+				Err:       err,
+			}
+		}
+	}()
 
-	// continue if the attribute was not included in the request
-	if val == nil {
-		return nil
+	if present {
+		if err := nb.setTouched(); err != nil {
+			return err
+		}
 	}
 
-	v := reflect.ValueOf(val)
+	// continue if the attribute was not included in the request, or was null
+	// without a sentinel to stand in for it
+	if val == nil {
+		if !present {
+			return nil
+		}
 
-	// Handle field of type time.Time
-	if nb.fieldValue.Type() == reflect.TypeOf(time.Time{}) {
-		if iso8601 {
-			var tm string
-			if v.Kind() == reflect.String {
-				tm = v.Interface().(string)
-			} else {
-				return ErrInvalidISO8601
-			}
+		sentinel, err := nullIfSentinel(nb.args, nb.fieldValue.Type())
+		if err != nil || !sentinel.IsValid() {
+			return err
+		}
 
-			t, err := time.Parse(iso8601TimeFormat, tm)
-			if err != nil {
-				return ErrInvalidISO8601
-			}
+		nb.fieldValue.Set(sentinel)
+		return nil
+	}
 
-			nb.fieldValue.Set(reflect.ValueOf(t))
+	// Registered decoders, custom attribute types and enums parse their own
+	// wire representation
+	if decode, dst := attributeDecoder(nb.fieldValue); decode != nil {
+		return decode(val, dst)
+	}
+	if unmarshaler := attrUnmarshaler(nb.fieldValue); unmarshaler != nil {
+		return unmarshaler.UnmarshalJSONAPIAttribute(val)
+	}
+	if scanner := enumScanner(nb.fieldValue); scanner != nil {
+		return scanner.JSONAPIEnumScan(val)
+	}
 
-			return nil
+	// Raw JSON fields capture the attribute re-encoded, for decoding later
+	if rawType := reflect.TypeOf(json.RawMessage{}); nb.fieldValue.Type() == rawType ||
+		nb.fieldValue.Type() == reflect.PtrTo(rawType) {
+		raw, err := json.Marshal(val)
+		if err != nil {
+			return err
 		}
 
-		var at int64
-
-		if v.Kind() == reflect.Float64 {
-			at = int64(v.Interface().(float64))
-		} else if v.Kind() == reflect.Int {
-			at = v.Int()
+		if nb.fieldValue.Kind() == reflect.Ptr {
+			nb.fieldValue.Set(reflect.ValueOf((*json.RawMessage)(&raw)))
 		} else {
-			return ErrInvalidTime
+			nb.fieldValue.Set(reflect.ValueOf(json.RawMessage(raw)))
 		}
-
-		t := time.Unix(at, 0)
-
-		nb.fieldValue.Set(reflect.ValueOf(t))
 		return nil
 	}
 
-	if nb.fieldValue.Type() == reflect.TypeOf([]string{}) {
-		values := make([]string, v.Len())
-		for i := 0; i < v.Len(); i++ {
-			values[i] = v.Index(i).Interface().(string)
+	v := reflect.ValueOf(val)
+
+	// Handle field of type time.Time, or a type defined from it
+	if isTime(nb.fieldValue.Type()) {
+		t, err := parseTime(v, layout, iso8601, dateOnly, nb.opts.lenientISO8601)
+		if err != nil {
+			return err
 		}
 
-		nb.fieldValue.Set(reflect.ValueOf(values))
+		setTime(nb.fieldValue, t)
 		return nil
 	}
 
-	if nb.fieldValue.Type() == reflect.TypeOf(new(time.Time)) {
-		if iso8601 {
-			var tm string
-			if v.Kind() == reflect.String {
-				tm = v.Interface().(string)
-			} else {
-				return ErrInvalidISO8601
+	// Handle slices, including named slice types and pointers to them
+	sliceType := nb.fieldValue.Type()
+	if sliceType.Kind() == reflect.Ptr {
+		sliceType = sliceType.Elem()
+	}
+	if sliceType.Kind() == reflect.Slice && v.Kind() == reflect.Slice {
+		values := reflect.MakeSlice(sliceType, v.Len(), v.Len())
+		elemType := sliceType.Elem()
+		for i := 0; i < v.Len(); i++ {
+			elem := reflect.ValueOf(v.Index(i).Interface())
+
+			// Times are parsed per the field's time format
+			// null elements are left as zero values
+			if !elem.IsValid() {
+				continue
 			}
 
-			v, err := time.Parse(iso8601TimeFormat, tm)
+			if isTime(elemType) || isTimePtr(elemType) {
+
+				t, err := parseTime(elem, layout, iso8601, dateOnly, nb.opts.lenientISO8601)
+				if err != nil {
+					return err
+				}
+
+				setTime(values.Index(i), t)
+				continue
+			}
+
+			if elem.Kind() == reflect.Float64 {
+				if err := checkIntegral(elem.Float(), elemType.Kind()); err != nil {
+					return err
+				}
+			}
+			if elem.Type().ConvertibleTo(elemType) {
+				values.Index(i).Set(elem.Convert(elemType))
+				continue
+			}
+
+			// Other elements, e.g. structs, are decoded through encoding/json
+			buf, err := json.Marshal(elem.Interface())
 			if err != nil {
-				return ErrInvalidISO8601
+				return err
 			}
+			if err := json.Unmarshal(buf, values.Index(i).Addr().Interface()); err != nil {
+				return ErrInvalidType
+			}
+		}
 
-			t := &v
+		if nb.fieldValue.Kind() == reflect.Ptr {
+			ptr := reflect.New(sliceType)
+			ptr.Elem().Set(values)
+			values = ptr
+		}
 
-			nb.fieldValue.Set(reflect.ValueOf(t))
+		nb.fieldValue.Set(values)
+		return nil
+	}
 
-			return nil
+	// Maps, e.g. map[string]string, are decoded into their own type through
+	// encoding/json
+	mapType := nb.fieldValue.Type()
+	if mapType.Kind() == reflect.Ptr {
+		mapType = mapType.Elem()
+	}
+	if mapType.Kind() == reflect.Map {
+		buf, err := json.Marshal(val)
+		if err != nil {
+			return err
 		}
 
-		var at int64
+		m := reflect.New(mapType)
+		if err := json.Unmarshal(buf, m.Interface()); err != nil {
+			return ErrInvalidType
+		}
 
-		if v.Kind() == reflect.Float64 {
-			at = int64(v.Interface().(float64))
-		} else if v.Kind() == reflect.Int {
-			at = v.Int()
+		if nb.fieldValue.Kind() == reflect.Ptr {
+			nb.fieldValue.Set(m)
 		} else {
-			return ErrInvalidTime
+			nb.fieldValue.Set(m.Elem())
 		}
+		return nil
+	}
 
-		v := time.Unix(at, 0)
-		t := &v
-
-		nb.fieldValue.Set(reflect.ValueOf(t))
+	if isTimePtr(nb.fieldValue.Type()) {
+		t, err := parseTime(v, layout, iso8601, dateOnly, nb.opts.lenientISO8601)
+		if err != nil {
+			return err
+		}
 
+		setTime(nb.fieldValue, t)
 		return nil
 	}
 
@@ -525,12 +1116,29 @@ func (nb nodeBuilder) doAttribute() error {
 }
 
 func (nb nodeBuilder) doRelation(included *map[string]*Node) error {
-	isSlice := nb.fieldValue.Type().Kind() == reflect.Slice
+	// A relationship keyed by id is decoded as a to-many relationship
+	asMap := mapRelation(nb.args)
+	if asMap {
+		if err := checkMapRelation(nb.fieldValue.Type()); err != nil {
+			return err
+		}
+	}
+	isSlice := nb.fieldValue.Type().Kind() == reflect.Slice || asMap
 
 	if nb.node.Relationships == nil || nb.node.Relationships[nb.args[1]] == nil {
 		return nil
 	}
 
+	if err := nb.setTouched(); err != nil {
+		return err
+	}
+
+	// An ids only relationship fills its ids field without building models
+	idsOnly, err := idsOnlyRelation(nb.args)
+	if err != nil {
+		return err
+	}
+
 	if isSlice {
 		// to-many relationship
 		relationship := new(RelationshipManyNode)
@@ -539,22 +1147,60 @@ func (nb nodeBuilder) doRelation(included *map[string]*Node) error {
 
 		json.NewEncoder(buf).Encode(nb.node.Relationships[nb.args[1]])
 		json.NewDecoder(buf).Decode(relationship)
+		nb.setRelationshipMeta(relationship.Meta)
 
 		data := relationship.Data
-		models := reflect.New(nb.fieldValue.Type()).Elem()
+		if err := nb.setRelationIDs(data...); err != nil || idsOnly {
+			return err
+		}
+
+		var models reflect.Value
+		switch {
+		case asMap:
+			models = reflect.MakeMapWithSize(nb.fieldValue.Type(), len(data))
+		case nb.opts.reuseRelationSlices && nb.fieldValue.Cap() > 0:
+			// The caller preallocated the slice; reuse its backing array
+			// rather than growing a new one element by element
+			models = nb.fieldValue.Slice(0, 0)
+		case len(data) > 0:
+			models = reflect.MakeSlice(nb.fieldValue.Type(), 0, len(data))
+		default:
+			models = reflect.New(nb.fieldValue.Type()).Elem()
+		}
 
+		elemType := nb.fieldValue.Type().Elem()
 		for _, n := range data {
-			m := reflect.New(nb.fieldValue.Type().Elem().Elem())
+			modelType, err := nb.relatedType(n, elemType)
+			if err != nil {
+				return err
+			}
+
+			m := reflect.New(modelType.Elem())
+
+			related, err := nb.relatedNode(n, modelType, included)
+			if err != nil {
+				return err
+			}
 
 			if err := unmarshalNode(
-				fullNode(n, included),
+				related,
 				m,
 				included,
+				nb.opts,
 			); err != nil {
 				return err
 
 			}
-
+			setLinkageMeta(m, n)
+
+			if asMap {
+				key := reflect.ValueOf(n.ID).Convert(nb.fieldValue.Type().Key())
+				if n.ID == "" || models.MapIndex(key).IsValid() {
+					return fmt.Errorf("%w: %s %q", ErrInvalidRelationKey, nb.args[1], n.ID)
+				}
+				models.SetMapIndex(key, m)
+				continue
+			}
 			models = reflect.Append(models, m)
 		}
 
@@ -569,6 +1215,7 @@ func (nb nodeBuilder) doRelation(included *map[string]*Node) error {
 			nb.node.Relationships[nb.args[1]],
 		)
 		json.NewDecoder(buf).Decode(relationship)
+		nb.setRelationshipMeta(relationship.Meta)
 
 		/*
 			http://jsonapi.org/format/#document-resource-object-relationships
@@ -580,31 +1227,245 @@ func (nb nodeBuilder) doRelation(included *map[string]*Node) error {
 			return nil
 		}
 
-		m := reflect.New(nb.fieldValue.Type().Elem())
+		if err := nb.setRelationIDs(relationship.Data); err != nil || idsOnly {
+			return err
+		}
+
+		// A to-one relation may be a struct value rather than a pointer
+		isValue := nb.fieldValue.Kind() == reflect.Struct
+
+		var m reflect.Value
+		if isValue {
+			m = reflect.New(nb.fieldValue.Type())
+		} else {
+			modelType, err := nb.relatedType(relationship.Data, nb.fieldValue.Type())
+			if err != nil {
+				return err
+			}
+			m = reflect.New(modelType.Elem())
+		}
+
+		related, err := nb.relatedNode(relationship.Data, m.Type(), included)
+		if err != nil {
+			return err
+		}
+
 		if err := unmarshalNode(
-			fullNode(relationship.Data, included),
+			related,
 			m,
 			included,
+			nb.opts,
 		); err != nil {
 			return err
 		}
+		setLinkageMeta(m, relationship.Data)
+
+		if isValue {
+			nb.fieldValue.Set(m.Elem())
+		} else {
+			nb.fieldValue.Set(m)
+		}
+
+	}
+	return nil
+}
+
+// relatedType returns the struct pointer type a related resource n is
+// unmarshaled into for a field, or slice element, of type t. Polymorphic
+// relationships, declared as interfaces, take it from the type registry.
+func (nb nodeBuilder) relatedType(n *Node, t reflect.Type) (reflect.Type, error) {
+	if t.Kind() != reflect.Interface {
+		return t, nil
+	}
+
+	modelType, err := nb.opts.types.lookup(n.Type, nb.opts)
+	if err != nil {
+		return nil, err
+	}
+	if !modelType.Implements(t) {
+		return nil, ErrInvalidType
+	}
+	return modelType, nil
+}
+
+// attribute returns the value stored under the attribute path, looking it up
+// with the WithAttributeKeyPrefix prefix first and then by its literal name.
+func (nb nodeBuilder) attribute(path []string) (interface{}, bool) {
+	if prefix := nb.opts.attributeKeyPrefix; prefix != "" {
+		prefixed := append([]string{prefix + path[0]}, path[1:]...)
+		if val, ok := nb.node.attribute(prefixed); ok {
+			return val, true
+		}
+	}
+
+	return nb.node.attribute(path)
+}
+
+// relatedNode returns the full node of the relationship linkage n, or just the
+// linkage when the resource is part of a cycle, checking
+// that its type is the one declared by the primary tag of modelType. Under
+// WithLenientRelationshipTypes a mismatching node is unmarshaled as if it were
+// of the declared type instead.
+func (nb nodeBuilder) relatedNode(n *Node, modelType reflect.Type,
+	included *map[string]*Node) (*Node, error) {
+	full := fullNode(n, included, nb.opts)
+
+	// A resource already being unmarshaled further up the graph is only
+	// linked, so that a cycle through included doesn't recurse forever
+	if len(nb.opts.resolving) > 0 && nb.opts.resolving[resolvingKey(n, nb.opts)] {
+		full = n
+	}
+
+	expected := primaryType(modelType)
+	if expected == "" || n.Type == expected ||
+		(nb.opts.caseInsensitiveTypes && strings.EqualFold(n.Type, expected)) {
+		return full, nil
+	}
+
+	if !nb.opts.lenientRelationshipTypes {
+		return nil, fmt.Errorf("%w: relationship %q expects %q, got %q",
+			ErrRelationshipTypeMismatch, nb.args[1], expected, n.Type)
+	}
+
+	retyped := *full
+	retyped.Type = expected
+	return &retyped, nil
+}
+
+// setLinkageMeta hands the meta of a relationship linkage entry to the related
+// model m, if it implements LinkageMetaSettable.
+func setLinkageMeta(m reflect.Value, linkage *Node) {
+	if settable, ok := m.Interface().(LinkageMetaSettable); ok && linkage.Meta != nil {
+		settable.SetJSONAPILinkageMeta(linkage.Meta)
+	}
+}
+
+// setRelationshipMeta hands the meta of the relationship to the model, if it
+// implements RelationshipMetaUnmarshaler.
+func (nb nodeBuilder) setRelationshipMeta(meta *Meta) {
+	if meta == nil {
+		return
+	}
+	if unmarshaler, ok := nb.modelValue.Addr().Interface().(RelationshipMetaUnmarshaler); ok {
+		unmarshaler.SetJSONAPIRelationshipMeta(nb.args[1], meta)
+	}
+}
+
+// setRelationIDs fills the sibling field named by an "ids:" relation tag
+// argument with the ids of the relationship linkage.
+func (nb nodeBuilder) setRelationIDs(linkage ...*Node) error {
+	name := relationIDsFieldName(nb.args)
+	if name == "" {
+		return nil
+	}
+
+	field := nb.modelValue.FieldByName(name)
+	if !field.IsValid() || field.Type() != reflect.TypeOf([]string{}) {
+		return ErrBadJSONAPIStructTag
+	}
+
+	ids := make([]string, 0, len(linkage))
+	for _, n := range linkage {
+		ids = append(ids, n.ID)
+	}
+
+	field.Set(reflect.ValueOf(ids))
+	return nil
+}
+
+// setTouched sets the sibling bool field named by the "touched:" tag argument,
+// the relationship or attribute being present even if it is null.
+func (nb nodeBuilder) setTouched() error {
+	name := tagArg(nb.args, annotationTouched)
+	if name == "" {
+		return nil
+	}
 
-		nb.fieldValue.Set(m)
+	field := nb.modelValue.FieldByName(name)
+	if !field.IsValid() || field.Kind() != reflect.Bool {
+		return ErrBadJSONAPIStructTag
+	}
+
+	field.SetBool(true)
+	return nil
+}
 
+// enumScanner returns the field as a JSONAPIEnumScanner, allocating a nil
+// pointer field first, or nil when the field's type doesn't implement it.
+func enumScanner(field reflect.Value) JSONAPIEnumScanner {
+	scanner, _ := implementation(field, reflect.TypeOf((*JSONAPIEnumScanner)(nil)).Elem()).(JSONAPIEnumScanner)
+	return scanner
+}
+
+// attrUnmarshaler returns the field as an AttrUnmarshaler, allocating a nil
+// pointer field first, or nil when the field's type doesn't implement it.
+func attrUnmarshaler(field reflect.Value) AttrUnmarshaler {
+	unmarshaler, _ := implementation(field, reflect.TypeOf((*AttrUnmarshaler)(nil)).Elem()).(AttrUnmarshaler)
+	return unmarshaler
+}
+
+// implementation returns the field, or its address, as the interface type
+// iface, allocating a nil pointer field first, or nil when neither implements
+// it.
+func implementation(field reflect.Value, iface reflect.Type) interface{} {
+	if field.Kind() == reflect.Ptr && field.Type().Implements(iface) {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		return field.Interface()
+	}
+
+	if field.CanAddr() && reflect.PtrTo(field.Type()).Implements(iface) {
+		return field.Addr().Interface()
 	}
+
 	return nil
 }
 
-func fullNode(n *Node, included *map[string]*Node) *Node {
-	includedKey := fmt.Sprintf("%s,%s", n.Type, n.ID)
+func fullNode(n *Node, included *map[string]*Node, o *options) *Node {
+	key := includedKey(n, o)
 
-	if included != nil && (*included)[includedKey] != nil {
-		return (*included)[includedKey]
+	if included != nil && (*included)[key] != nil {
+		return (*included)[key]
 	}
 
 	return n
 }
 
+// includedKey identifies n within the included map by its type and id, the
+// type is folded to lower case under WithCaseInsensitiveTypes.
+func includedKey(n *Node, o *options) string {
+	nodeType := n.Type
+	if o.caseInsensitiveTypes {
+		nodeType = strings.ToLower(nodeType)
+	}
+
+	return fmt.Sprintf("%s,%s", nodeType, n.ID)
+}
+
+// resolvingKey identifies n within o.resolving like includedKey, without
+// formatting a string for every node and linkage member.
+func resolvingKey(n *Node, o *options) resourceKey {
+	if o.caseInsensitiveTypes {
+		return resourceKey{strings.ToLower(n.Type), n.ID}
+	}
+	return resourceKey{n.Type, n.ID}
+}
+
+// checkIntegral returns ErrInvalidType when the JSON number f, decoded into a
+// slice element of the given kind, is fractional for an integer kind rather
+// than silently truncating it. Scalar attributes keep truncating.
+func checkIntegral(f float64, kind reflect.Kind) error {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if f != math.Trunc(f) {
+			return ErrInvalidType
+		}
+	}
+	return nil
+}
+
 // assign will take the value specified and assign it to the field; if
 // field is expecting a ptr assign will assign a ptr.
 func assign(field, value reflect.Value) {
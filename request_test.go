@@ -3,8 +3,11 @@ package jsonapi
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"reflect"
 	"sort"
 	"strings"
@@ -45,6 +48,179 @@ func TestUnmarshall_attrStringSlice(t *testing.T) {
 	}
 }
 
+func TestUnmarshall_attrNamedSlicePointer(t *testing.T) {
+	type TagList []string
+	type Scores []int
+
+	type Article struct {
+		ID     int      `jsonapi:"primary,articles"`
+		Tags   *TagList `jsonapi:"attr,tags"`
+		Scores Scores   `jsonapi:"attr,scores"`
+	}
+
+	tags := TagList{"fiction", "sale"}
+	in := &Article{ID: 1, Tags: &tags, Scores: Scores{3, 5}}
+
+	buf := bytes.NewBuffer(nil)
+	if err := MarshalPayload(buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(Article)
+	if err := UnmarshalPayload(buf, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Tags == nil {
+		t.Fatal("Was expecting the tags pointer to be set")
+	}
+	if !reflect.DeepEqual(*in.Tags, *out.Tags) {
+		t.Fatalf("Was expecting tags %v, got %v", *in.Tags, *out.Tags)
+	}
+	if !reflect.DeepEqual(in.Scores, out.Scores) {
+		t.Fatalf("Was expecting scores %v, got %v", in.Scores, out.Scores)
+	}
+}
+
+func TestUnmarshalSliceAttributeElements(t *testing.T) {
+	type Scores []int
+
+	type Article struct {
+		ID     int           `jsonapi:"primary,articles"`
+		Scores Scores        `jsonapi:"attr,scores"`
+		Ranks  []*int        `jsonapi:"attr,ranks"`
+		Values []interface{} `jsonapi:"attr,values"`
+		Count  int           `jsonapi:"attr,count"`
+	}
+
+	body := `{"data": {"type": "articles", "id": "1", "attributes": {
+		"scores": [3, null, 5], "ranks": [1, null], "values": ["a", null, 2]}}}`
+	out := new(Article)
+	if err := UnmarshalPayload(strings.NewReader(body), out); err != nil {
+		t.Fatal(err)
+	}
+	if e := (Scores{3, 0, 5}); !reflect.DeepEqual(e, out.Scores) {
+		t.Fatalf("Was expecting scores %v, got %v", e, out.Scores)
+	}
+	if len(out.Ranks) != 2 || out.Ranks[0] == nil || *out.Ranks[0] != 1 || out.Ranks[1] != nil {
+		t.Fatalf("Was expecting ranks [1 nil], got %v", out.Ranks)
+	}
+	if e := []interface{}{"a", nil, float64(2)}; !reflect.DeepEqual(e, out.Values) {
+		t.Fatalf("Was expecting values %v, got %v", e, out.Values)
+	}
+
+	for _, attributes := range []string{`{"scores": [1.5]}`, `{"ranks": [2.5]}`} {
+		body := `{"data": {"type": "articles", "id": "1", "attributes": ` + attributes + `}}`
+		err := UnmarshalPayload(strings.NewReader(body), new(Article))
+		if !errors.Is(err, ErrInvalidType) {
+			t.Fatalf("Was expecting ErrInvalidType for the fractional %s, got %v", attributes, err)
+		}
+	}
+
+	// A scalar attribute still truncates, as it always has
+	body = `{"data": {"type": "articles", "id": "1", "attributes": {"count": 1.5}}}`
+	out = new(Article)
+	if err := UnmarshalPayload(strings.NewReader(body), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Count != 1 {
+		t.Fatalf("Was expecting the count to be truncated to 1, got %d", out.Count)
+	}
+}
+
+func TestNestedAttributePath(t *testing.T) {
+	type Venue struct {
+		ID      int    `jsonapi:"primary,venues"`
+		City    string `jsonapi:"attr,address.city,nested"`
+		Street  string `jsonapi:"attr,address.street,nested"`
+		Literal string `jsonapi:"attr,dotted.key"`
+	}
+
+	in := &Venue{ID: 1, City: "Paris", Street: "Rue de Rivoli", Literal: "as is"}
+	buf := bytes.NewBuffer(nil)
+	if err := MarshalPayload(buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+	attributes := jsonData["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+
+	address, ok := attributes["address"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Was expecting a nested address object, got %v", attributes)
+	}
+	if address["city"] != "Paris" || address["street"] != "Rue de Rivoli" {
+		t.Fatalf("Unexpected nested address %v", address)
+	}
+	if attributes["dotted.key"] != "as is" {
+		t.Fatal("Was expecting an untagged dotted name to stay a literal key")
+	}
+
+	out := new(Venue)
+	if err := UnmarshalPayload(bytes.NewReader(buf.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("Got %+v Expected %+v", out, in)
+	}
+}
+
+func TestEnumAttribute(t *testing.T) {
+	previous := StatusArchived
+	in := &Project{ID: 1, Status: StatusActive, Previous: &previous}
+
+	buf := bytes.NewBuffer(nil)
+	if err := MarshalPayload(buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.Unmarshal(buf.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "active", resp.Data.Attributes["status"]; e != a {
+		t.Fatalf("Was expecting status %s, got %v", e, a)
+	}
+
+	out := new(Project)
+	if err := UnmarshalPayload(bytes.NewReader(buf.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("Got %+v Expected %+v", out, in)
+	}
+
+	// the numeric code is accepted too
+	data, _ := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       "projects",
+			"id":         "1",
+			"attributes": map[string]interface{}{"status": 2},
+		},
+	})
+	out = new(Project)
+	if err := UnmarshalPayload(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Status != StatusArchived {
+		t.Fatalf("Was expecting status %v, got %v", StatusArchived, out.Status)
+	}
+
+	data, _ = json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       "projects",
+			"id":         "1",
+			"attributes": map[string]interface{}{"status": "bogus"},
+		},
+	})
+	if err := UnmarshalPayload(bytes.NewReader(data), new(Project)); err == nil {
+		t.Fatal("Was expecting the scan error to be returned")
+	}
+}
+
 func TestUnmarshalToStructWithPointerAttr(t *testing.T) {
 	out := new(WithPointer)
 	in := map[string]interface{}{
@@ -206,15 +382,14 @@ func TestUnmarshalInvalidJSON_BadType(t *testing.T) {
 			out := new(ModelBadTypes)
 			in := map[string]interface{}{}
 			in[test.Field] = test.BadValue
-			expectedErrorMessage := test.Error.Error()
 
 			err := UnmarshalPayload(samplePayloadWithBadTypes(in), out)
 
 			if err == nil {
 				t.Fatalf("Expected error due to invalid type.")
 			}
-			if err.Error() != expectedErrorMessage {
-				t.Fatalf("Unexpected error message: %s", err.Error())
+			if !errors.Is(err, test.Error) {
+				t.Fatalf("Unexpected error: %s", err.Error())
 			}
 		})
 	}
@@ -316,6 +491,26 @@ func TestUnmarshalParsesISO8601TimePointer(t *testing.T) {
 	}
 }
 
+func TestUnmarshalAttributeError(t *testing.T) {
+	err := UnmarshalPayload(
+		samplePayloadWithBadTypes(map[string]interface{}{"float_field": "A string."}),
+		new(ModelBadTypes),
+	)
+
+	var attrErr *AttributeError
+	if !errors.As(err, &attrErr) {
+		t.Fatalf("Was expecting an *AttributeError, got %v", err)
+	}
+	if attrErr.Attribute != "float_field" || attrErr.Field != "ModelBadTypes.FloatField" {
+		t.Fatalf("Was expecting the attribute and field names, got %#v", attrErr)
+	}
+
+	e := `invalid type for attribute "float_field" (field ModelBadTypes.FloatField): expected float64, got string`
+	if err.Error() != e {
+		t.Fatalf("Was expecting %q, got %q", e, err.Error())
+	}
+}
+
 func TestUnmarshalInvalidISO8601(t *testing.T) {
 	payload := &OnePayload{
 		Data: &Node{
@@ -336,231 +531,1593 @@ func TestUnmarshalInvalidISO8601(t *testing.T) {
 	}
 }
 
-func TestUnmarshalRelationshipsWithoutIncluded(t *testing.T) {
-	data, _ := payload(samplePayloadWithoutIncluded())
-	in := bytes.NewReader(data)
-	out := new(Post)
+func TestUnmarshalLenientISO8601(t *testing.T) {
+	body := `{"data": {"type": "timestamps", "id": "1", "attributes": {"timestamp": 1471422432, "next": "2016-08-17T08:27:12Z"}}}`
 
-	if err := UnmarshalPayload(in, out); err != nil {
+	if err := UnmarshalPayload(strings.NewReader(body), new(Timestamp)); err != ErrInvalidISO8601 {
+		t.Fatalf("Expected ErrInvalidISO8601, got %v", err)
+	}
+
+	out := new(Timestamp)
+	if err := UnmarshalPayload(strings.NewReader(body), out, WithLenientISO8601()); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify each comment has at least an ID
-	for _, comment := range out.Comments {
-		if comment.ID == 0 {
-			t.Fatalf("The comment did not have an ID")
-		}
+	expected := time.Date(2016, 8, 17, 8, 27, 12, 0, time.UTC)
+	if !out.Time.Equal(expected) {
+		t.Fatalf("Was expecting the unix timestamp to parse as %v, got %v", expected, out.Time)
+	}
+	if out.Next == nil || !out.Next.Equal(expected) {
+		t.Fatalf("Was expecting the ISO8601 timestamp to still parse, got %v", out.Next)
 	}
 }
 
-func TestUnmarshalRelationships(t *testing.T) {
-	out, err := unmarshalSamplePayload()
-	if err != nil {
-		t.Fatal(err)
+func TestUnmarshalParsesDateOnly(t *testing.T) {
+	payload := &OnePayload{
+		Data: &Node{
+			Type: "people",
+			Attributes: map[string]interface{}{
+				"dob":         "1990-04-23",
+				"anniversary": "2015-06-01",
+			},
+		},
 	}
 
-	if out.CurrentPost == nil {
-		t.Fatalf("Current post was not materialized")
-	}
+	in := bytes.NewBuffer(nil)
+	json.NewEncoder(in).Encode(payload)
 
-	if out.CurrentPost.Title != "Bas" || out.CurrentPost.Body != "Fuubar" {
-		t.Fatalf("Attributes were not set")
+	out := new(Person)
+
+	if err := UnmarshalPayload(in, out); err != nil {
+		t.Fatal(err)
 	}
 
-	if len(out.Posts) != 2 {
-		t.Fatalf("There should have been 2 posts")
+	if expected := time.Date(1990, 4, 23, 0, 0, 0, 0, time.UTC); !out.Birthday.Equal(expected) {
+		t.Fatalf("Expected %v, got %v", expected, out.Birthday)
+	}
+	if expected := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC); out.Anniversary == nil || !out.Anniversary.Equal(expected) {
+		t.Fatalf("Expected %v, got %v", expected, out.Anniversary)
 	}
 }
 
-func TestUnmarshalNullRelationship(t *testing.T) {
-	sample := map[string]interface{}{
-		"data": map[string]interface{}{
-			"type": "posts",
-			"id":   "1",
-			"attributes": map[string]interface{}{
-				"body":  "Hello",
-				"title": "World",
-			},
-			"relationships": map[string]interface{}{
-				"latest_comment": map[string]interface{}{
-					"data": nil, // empty to-one relationship
+func TestUnmarshalInvalidDateOnly(t *testing.T) {
+	for _, dob := range []interface{}{"2016-08-17T08:27:12Z", "23/04/1990", 640828800} {
+		payload := &OnePayload{
+			Data: &Node{
+				Type: "people",
+				Attributes: map[string]interface{}{
+					"dob": dob,
 				},
 			},
-		},
+		}
+
+		in := bytes.NewBuffer(nil)
+		json.NewEncoder(in).Encode(payload)
+
+		out := new(Person)
+
+		if err := UnmarshalPayload(in, out); err != ErrInvalidDateOnly {
+			t.Fatalf("Expected ErrInvalidDateOnly for %v, got %v", dob, err)
+		}
 	}
-	data, err := json.Marshal(sample)
-	if err != nil {
-		t.Fatal(err)
+}
+
+func TestUnmarshalIDComposite(t *testing.T) {
+	payload := &OnePayload{
+		Data: &Node{
+			Type: "widgets",
+			ID:   "acme:42",
+			Attributes: map[string]interface{}{
+				"name": "sprocket",
+			},
+		},
 	}
 
-	in := bytes.NewReader(data)
-	out := new(Post)
+	in := bytes.NewBuffer(nil)
+	json.NewEncoder(in).Encode(payload)
 
+	out := new(Widget)
 	if err := UnmarshalPayload(in, out); err != nil {
 		t.Fatal(err)
 	}
 
-	if out.LatestComment != nil {
-		t.Fatalf("Latest Comment was not set to nil")
+	if out.Tenant != "acme" || out.Number != 42 || out.Name != "sprocket" {
+		t.Fatalf("Unexpected widget %#v", out)
+	}
+
+	payload.Data.ID = "acme"
+	in.Reset()
+	json.NewEncoder(in).Encode(payload)
+
+	if err := UnmarshalPayload(in, new(Widget)); err == nil {
+		t.Fatal("Was expecting the JSONAPISetID error to be returned")
 	}
 }
 
-func TestUnmarshalNullRelationshipInSlice(t *testing.T) {
-	sample := map[string]interface{}{
-		"data": map[string]interface{}{
-			"type": "posts",
-			"id":   "1",
-			"attributes": map[string]interface{}{
-				"body":  "Hello",
-				"title": "World",
+func TestUnmarshalMetaFields(t *testing.T) {
+	payload := &OnePayload{
+		Data: &Node{
+			Type: "documents",
+			ID:   "1",
+			Attributes: map[string]interface{}{
+				"title": "Draft",
 			},
-			"relationships": map[string]interface{}{
-				"comments": map[string]interface{}{
-					"data": []interface{}{}, // empty to-many relationships
-				},
+			Meta: &Meta{
+				"revision": 3,
+				"verified": true,
 			},
 		},
 	}
-	data, err := json.Marshal(sample)
-	if err != nil {
-		t.Fatal(err)
-	}
 
-	in := bytes.NewReader(data)
-	out := new(Post)
+	in := bytes.NewBuffer(nil)
+	json.NewEncoder(in).Encode(payload)
 
+	out := new(Document)
 	if err := UnmarshalPayload(in, out); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(out.Comments) != 0 {
-		t.Fatalf("Wrong number of comments; Comments should be empty")
+	if out.Revision != 3 {
+		t.Fatalf("Was expecting revision 3, got %d", out.Revision)
+	}
+	if out.Verified {
+		t.Fatal("Was expecting the readonly verified meta to be ignored")
 	}
 }
 
-func TestUnmarshalNestedRelationships(t *testing.T) {
-	out, err := unmarshalSamplePayload()
-	if err != nil {
-		t.Fatal(err)
+func TestTimeLayoutRoundTrip(t *testing.T) {
+	updated := time.Date(2016, 8, 18, 9, 0, 0, 0, time.UTC)
+	archived := time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)
+	article := &Article{
+		ID:        1,
+		Published: time.Date(2016, 8, 17, 8, 27, 12, 0, time.UTC),
+		Updated:   &updated,
+		Archived:  &archived,
 	}
 
-	if out.CurrentPost == nil {
-		t.Fatalf("Current post was not materialized")
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, article); err != nil {
+		t.Fatal(err)
 	}
 
-	if out.CurrentPost.Comments == nil {
-		t.Fatalf("Did not materialize nested records, comments")
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "Wed, 17 Aug 2016 08:27:12 UTC", payload.Data.Attributes["published"]; e != a {
+		t.Fatalf("Was expecting published %v, got %v", e, a)
+	}
+	if e, a := "Thu, 18 Aug 2016 09:00:00 UTC", payload.Data.Attributes["updated"]; e != a {
+		t.Fatalf("Was expecting updated %v, got %v", e, a)
+	}
+	if e, a := "31/01/2017", payload.Data.Attributes["archived"]; e != a {
+		t.Fatalf("Was expecting archived %v, got %v", e, a)
 	}
 
-	if len(out.CurrentPost.Comments) != 2 {
-		t.Fatalf("Wrong number of comments")
+	dst := new(Article)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Published.Equal(article.Published) {
+		t.Fatalf("Was expecting published %v, got %v", article.Published, dst.Published)
+	}
+	if dst.Updated == nil || !dst.Updated.Equal(updated) {
+		t.Fatalf("Was expecting updated %v, got %v", updated, dst.Updated)
+	}
+	if dst.Archived == nil || !dst.Archived.Equal(archived) {
+		t.Fatalf("Was expecting archived %v, got %v", archived, dst.Archived)
 	}
 }
 
-func TestUnmarshalRelationshipsSerializedEmbedded(t *testing.T) {
-	out := sampleSerializedEmbeddedTestModel()
-
-	if out.CurrentPost == nil {
-		t.Fatalf("Current post was not materialized")
+func TestUnmarshalInvalidTimeLayout(t *testing.T) {
+	payload := &OnePayload{
+		Data: &Node{
+			Type: "articles",
+			Attributes: map[string]interface{}{
+				"published": "2016-08-17T08:27:12Z",
+			},
+		},
 	}
 
-	if out.CurrentPost.Title != "Foo" || out.CurrentPost.Body != "Bar" {
-		t.Fatalf("Attributes were not set")
-	}
+	in := bytes.NewBuffer(nil)
+	json.NewEncoder(in).Encode(payload)
 
-	if len(out.Posts) != 2 {
-		t.Fatalf("There should have been 2 posts")
+	err := UnmarshalPayload(in, new(Article))
+	if !errors.Is(err, ErrInvalidTimeLayout) {
+		t.Fatalf("Expected ErrInvalidTimeLayout, got %v", err)
 	}
-
-	if out.Posts[0].LatestComment.Body != "foo" {
-		t.Fatalf("The comment body was not set")
+	if !strings.Contains(err.Error(), "2016-08-17T08:27:12Z") {
+		t.Fatalf("Was expecting the error to include the received value, got %s", err)
 	}
 }
 
-func TestUnmarshalNestedRelationshipsEmbedded(t *testing.T) {
+func TestTimeSliceRoundTrip(t *testing.T) {
+	closure := time.Date(2016, 12, 26, 0, 0, 0, 0, time.UTC)
+	schedule := &Schedule{
+		ID: 1,
+		Holidays: []time.Time{
+			time.Date(2016, 12, 25, 0, 0, 0, 0, time.UTC),
+			time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		Closures: []*time.Time{&closure, nil},
+		Openings: []time.Time{time.Unix(1472024400, 0)},
+	}
+
 	out := bytes.NewBuffer(nil)
-	if err := MarshalOnePayloadEmbedded(out, testModel()); err != nil {
+	if err := MarshalPayload(out, schedule); err != nil {
 		t.Fatal(err)
 	}
 
-	model := new(Blog)
-
-	if err := UnmarshalPayload(out, model); err != nil {
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
 		t.Fatal(err)
 	}
-
-	if model.CurrentPost == nil {
-		t.Fatalf("Current post was not materialized")
+	expected := map[string]interface{}{
+		"holidays": []interface{}{"2016-12-25T00:00:00Z", "2017-01-01T00:00:00Z"},
+		"closures": []interface{}{"2016-12-26", nil},
+		"openings": []interface{}{float64(1472024400)},
 	}
-
-	if model.CurrentPost.Comments == nil {
-		t.Fatalf("Did not materialize nested records, comments")
+	if !reflect.DeepEqual(expected, payload.Data.Attributes) {
+		t.Fatalf("Was expecting attributes %v, got %v", expected, payload.Data.Attributes)
 	}
 
-	if len(model.CurrentPost.Comments) != 2 {
-		t.Fatalf("Wrong number of comments")
+	dst := new(Schedule)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
 	}
-
-	if model.CurrentPost.Comments[0].Body != "foo" {
-		t.Fatalf("Comment body not set")
+	if len(dst.Holidays) != 2 || !dst.Holidays[1].Equal(schedule.Holidays[1]) {
+		t.Fatalf("Was expecting holidays %v, got %v", schedule.Holidays, dst.Holidays)
+	}
+	if len(dst.Closures) != 2 || !dst.Closures[0].Equal(closure) || dst.Closures[1] != nil {
+		t.Fatalf("Was expecting closures %v, got %v", schedule.Closures, dst.Closures)
+	}
+	if len(dst.Openings) != 1 || !dst.Openings[0].Equal(schedule.Openings[0]) {
+		t.Fatalf("Was expecting openings %v, got %v", schedule.Openings, dst.Openings)
 	}
 }
 
-func TestUnmarshalRelationshipsSideloaded(t *testing.T) {
-	payload := samplePayloadWithSideloaded()
-	out := new(Blog)
+func TestNullIfRoundTrip(t *testing.T) {
+	listing := &Listing{ID: 1, Rank: -1, Rating: 4.5}
 
-	if err := UnmarshalPayload(payload, out); err != nil {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, listing); err != nil {
 		t.Fatal(err)
 	}
 
-	if out.CurrentPost == nil {
-		t.Fatalf("Current post was not materialized")
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"rank": nil, "rating": 4.5}
+	if !reflect.DeepEqual(expected, payload.Data.Attributes) {
+		t.Fatalf("Was expecting attributes %v, got %v", expected, payload.Data.Attributes)
+	}
+
+	dst := &Listing{Rating: 1}
+	body := `{"data": {"type": "listings", "id": "1", "attributes": {"rank": null}}}`
+	if err := UnmarshalPayload(strings.NewReader(body), dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Rank != -1 {
+		t.Fatalf("Was expecting a null rank to be -1, got %d", dst.Rank)
+	}
+	if dst.Rating != 1 {
+		t.Fatalf("Was expecting the missing rating to be left untouched, got %v", dst.Rating)
+	}
+}
+
+func TestNamedTimeRoundTrip(t *testing.T) {
+	ends := Instant(time.Unix(1472028000, 0))
+	session := &Session{
+		ID:     1,
+		Starts: Instant(time.Date(2016, 8, 24, 8, 0, 0, 0, time.UTC)),
+		Ends:   &ends,
+		Reruns: []Instant{Instant(time.Date(2016, 9, 1, 0, 0, 0, 0, time.UTC))},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, session); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"starts": "2016-08-24T08:00:00Z",
+		"ends":   float64(1472028000),
+		"reruns": []interface{}{"2016-09-01"},
+	}
+	if !reflect.DeepEqual(expected, payload.Data.Attributes) {
+		t.Fatalf("Was expecting attributes %v, got %v", expected, payload.Data.Attributes)
+	}
+
+	dst := new(Session)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !time.Time(dst.Starts).Equal(time.Time(session.Starts)) {
+		t.Fatalf("Was expecting starts %v, got %v", time.Time(session.Starts), time.Time(dst.Starts))
+	}
+	if dst.Ends == nil || !time.Time(*dst.Ends).Equal(time.Time(ends)) {
+		t.Fatalf("Was expecting ends %v, got %v", time.Time(ends), dst.Ends)
+	}
+	if len(dst.Reruns) != 1 || !time.Time(dst.Reruns[0]).Equal(time.Time(session.Reruns[0])) {
+		t.Fatalf("Was expecting reruns %v, got %v", session.Reruns, dst.Reruns)
+	}
+}
+
+func TestAttrMarshalerRoundTrip(t *testing.T) {
+	invoice := &Invoice{
+		ID:       1,
+		Total:    Money{Cents: 1999, Currency: "EUR"},
+		Discount: &Money{Cents: 250, Currency: "EUR"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, invoice); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"total":    map[string]interface{}{"amount": "19.99", "currency": "EUR"},
+		"discount": map[string]interface{}{"amount": "2.50", "currency": "EUR"},
+	}
+	if !reflect.DeepEqual(expected, payload.Data.Attributes) {
+		t.Fatalf("Was expecting attributes %v, got %v", expected, payload.Data.Attributes)
+	}
+
+	dst := new(Invoice)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(invoice, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", invoice, dst)
+	}
+
+	if err := MarshalPayload(out, &Invoice{ID: 2, Total: Money{Cents: 100}}); err == nil {
+		t.Fatal("Was expecting the attribute marshaler's error")
+	}
+}
+
+func TestRawMessageAttributeRoundTrip(t *testing.T) {
+	extra := json.RawMessage(`["a","b"]`)
+	pref := &Preference{
+		ID:       1,
+		Settings: json.RawMessage(`{"theme":"dark","sizes":[1,2]}`),
+		Extra:    &extra,
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, pref); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(out.Bytes(), []byte(`"settings":{"theme":"dark","sizes":[1,2]}`)) {
+		t.Fatalf("Was expecting the raw settings to be embedded verbatim, got %s", out)
+	}
+
+	dst := new(Preference)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	var settings struct {
+		Theme string `json:"theme"`
+		Sizes []int  `json:"sizes"`
+	}
+	if err := json.Unmarshal(dst.Settings, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings.Theme != "dark" || len(settings.Sizes) != 2 {
+		t.Fatalf("Was expecting the raw settings to decode, got %s", dst.Settings)
+	}
+	if dst.Extra == nil || string(*dst.Extra) != string(extra) {
+		t.Fatalf("Was expecting extra %s, got %v", extra, dst.Extra)
+	}
+}
+
+func TestAttributeCodecRoundTrip(t *testing.T) {
+	urlType := reflect.TypeOf(url.URL{})
+	defer UnregisterAttributeEncoder(urlType)
+	defer UnregisterAttributeDecoder(urlType)
+	RegisterAttributeEncoder(urlType, func(v reflect.Value) (interface{}, error) {
+		u := v.Interface().(url.URL)
+		return u.String(), nil
+	})
+	RegisterAttributeDecoder(urlType, func(raw interface{}, dst reflect.Value) error {
+		s, ok := raw.(string)
+		if !ok {
+			return ErrInvalidType
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(*u))
+		return nil
+	})
+
+	homepage, _ := url.Parse("https://example.com/about?lang=en")
+	site := &Site{ID: 1, Homepage: homepage}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, site); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"homepage": "https://example.com/about?lang=en"}
+	if !reflect.DeepEqual(expected, payload.Data.Attributes) {
+		t.Fatalf("Was expecting attributes %v, got %v", expected, payload.Data.Attributes)
+	}
+
+	dst := new(Site)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(site, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", site, dst)
+	}
+
+	body := `{"data": {"type": "sites", "id": "1", "attributes": {"mirror": 42}}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(Site)); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Was expecting the decoder's ErrInvalidType, got %v", err)
+	}
+
+	UnregisterAttributeEncoder(urlType)
+	UnregisterAttributeDecoder(urlType)
+	if fn, _ := attributeEncoder(reflect.ValueOf(homepage)); fn != nil {
+		t.Fatal("Was expecting the encoder to be unregistered")
+	}
+	if fn, _ := attributeDecoder(reflect.ValueOf(&dst.Homepage).Elem()); fn != nil {
+		t.Fatal("Was expecting the decoder to be unregistered")
+	}
+}
+
+func TestOpaqueIDRoundTrip(t *testing.T) {
+	ticket := &Ticket{ID: Token{Shard: 3, Seq: 42}, Subject: "Broken link"}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, ticket); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"id":"3.42"`)) {
+		t.Fatalf("Was expecting the stringified id, got %s", out)
+	}
+
+	dst := new(Ticket)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ticket, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", ticket, dst)
+	}
+
+	bookmark := &Bookmark{ID: &Cursor{Value: "abc"}}
+	out.Reset()
+	if err := MarshalPayload(out, bookmark); err != nil {
+		t.Fatal(err)
+	}
+
+	dstBookmark := new(Bookmark)
+	if err := UnmarshalPayload(out, dstBookmark); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bookmark, dstBookmark) {
+		t.Fatalf("Was expecting %#v, got %#v", bookmark.ID, dstBookmark.ID)
+	}
+
+	body := `{"data": {"type": "tickets", "id": "nope"}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(Ticket)); err == nil {
+		t.Fatal("Was expecting the id parser's error")
+	}
+}
+
+func TestIDMarshalerRoundTrip(t *testing.T) {
+	device := &Device{
+		ID:   UUID{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00},
+		Name: "sensor",
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, device); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"id":"123e4567-e89b-12d3-a456-426614174000"`)) {
+		t.Fatalf("Was expecting the marshaled uuid, got %s", out)
+	}
+
+	dst := new(Device)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(device, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", device, dst)
+	}
+
+	body := `{"data": {"type": "devices", "id": "not-a-uuid"}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(Device)); err == nil {
+		t.Fatal("Was expecting the id unmarshaler's error")
+	}
+}
+
+func TestSliceAttributesRoundTrip(t *testing.T) {
+	survey := &Survey{
+		ID:      1,
+		Scores:  []int{3, 5, 8},
+		Weights: []float64{0.25, 0.75},
+		Answers: []Answer{{Question: "color", Choice: 2}, {Question: "size", Choice: 1}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, survey); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(Survey)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(survey, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", survey, dst)
+	}
+
+	body := `{"data": {"type": "surveys", "id": "1", "attributes": {"scores": ["high"]}}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(Survey)); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Was expecting ErrInvalidType, got %v", err)
+	}
+}
+
+func TestMapAttributesRoundTrip(t *testing.T) {
+	labels := map[string]string{"env": "prod"}
+	asset := &Asset{
+		ID:       1,
+		Metadata: map[string]string{"owner": "ann", "mime": "image/png"},
+		Counts:   map[string]int{"views": 12, "downloads": 3},
+		Extra: map[string]interface{}{
+			"dimensions": map[string]interface{}{"width": float64(640), "height": float64(480)},
+			"tags":       []interface{}{"a", "b"},
+		},
+		Labels: &labels,
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, asset); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(Asset)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asset, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", asset, dst)
+	}
+
+	body := `{"data": {"type": "assets", "id": "1", "attributes": {"counts": {"views": "many"}}}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(Asset)); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Was expecting ErrInvalidType, got %v", err)
+	}
+}
+
+func TestUnmarshalAfterUnmarshaler(t *testing.T) {
+	sample := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{
+				"type":       "pages",
+				"id":         "1",
+				"attributes": map[string]interface{}{"title": "  Getting Started "},
+			},
+			map[string]interface{}{
+				"type":       "pages",
+				"id":         "2",
+				"attributes": map[string]interface{}{"title": "FAQ"},
+			},
+		},
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := UnmarshalManyPayload(bytes.NewReader(data), reflect.TypeOf(new(Page)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := pages[0].(*Page)
+	if page.Title != "Getting Started" || page.Slug != "getting-started" {
+		t.Fatalf("Was expecting the hook to normalize the page, got %#v", page)
+	}
+	if e, a := "faq", pages[1].(*Page).Slug; e != a {
+		t.Fatalf("Was expecting slug %s, got %s", e, a)
+	}
+
+	sample["data"] = map[string]interface{}{
+		"type":       "pages",
+		"id":         "3",
+		"attributes": map[string]interface{}{"title": " "},
+	}
+	if data, err = json.Marshal(sample); err != nil {
+		t.Fatal(err)
+	}
+
+	err = UnmarshalPayload(bytes.NewReader(data), new(Page))
+	if err == nil || err.Error() != "page 3 has no title" {
+		t.Fatalf("Was expecting the hook error, got %v", err)
+	}
+}
+
+func TestUnmarshalAfterUnmarshalerPanic(t *testing.T) {
+	body := `{"data": {"type": "fragiles", "id": "1", "relationships": {
+		"child": {"data": {"type": "fragiles", "id": "2"}}}}}`
+
+	defer func() {
+		if r := recover(); r != "fragile 2" {
+			t.Fatalf("Was expecting the hook's own panic, got %v", r)
+		}
+	}()
+
+	err := UnmarshalPayload(strings.NewReader(body), new(Fragile))
+	t.Fatalf("Was expecting a panic, got %v", err)
+}
+
+func TestMetaObjectRoundTrip(t *testing.T) {
+	report := &Report{ID: 1, Title: "Sales", Meta: &ReportMeta{GeneratedBy: "nightly", Rows: 42}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, report); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := &Meta{"generated-by": "nightly", "rows": float64(42)}
+	if !reflect.DeepEqual(expected, payload.Data.Meta) {
+		t.Fatalf("Was expecting meta %v, got %v", expected, payload.Data.Meta)
+	}
+
+	dst := new(Report)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", report.Meta, dst.Meta)
+	}
+
+	out.Reset()
+	if err := MarshalPayload(out, &Report{ID: 2, Title: "Empty"}); err != nil {
+		t.Fatal(err)
+	}
+	payload = new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Data.Meta != nil {
+		t.Fatalf("Was expecting a nil meta struct to be omitted, got %v", payload.Data.Meta)
+	}
+}
+
+func TestValueRelationRoundTrip(t *testing.T) {
+	review := &Review{ID: 1, Body: "Great", Author: Author{ID: 2, Name: "Ann"}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, review); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal(out.Bytes(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := payload.Data.Relationships["editor"]; exists {
+		t.Fatal("Was expecting the zero value editor to be omitted")
+	}
+	if len(payload.Included) != 1 || payload.Included[0].Type != "authors" {
+		t.Fatalf("Was expecting the author to be included, got %v", payload.Included)
+	}
+
+	dst := new(Review)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(review, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", review, dst)
+	}
+}
+
+func TestTouchedRelationRoundTrip(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		task     *Task
+		expected string
+	}{
+		{"absent", &Task{ID: 1, Assignee: &Author{ID: 2}}, ""},
+		{"null", &Task{ID: 1, AssigneeTouched: true}, `{"data":null}`},
+		{"set", &Task{ID: 1, Assignee: &Author{ID: 2}, AssigneeTouched: true}, `{"data":{"type":"authors","id":"2"}}`},
+	}
+
+	for _, scenario := range scenarios {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, scenario.task); err != nil {
+			t.Fatal(err)
+		}
+
+		var document struct {
+			Data struct {
+				Relationships map[string]json.RawMessage `json:"relationships"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &document); err != nil {
+			t.Fatal(err)
+		}
+		relationship, exists := document.Data.Relationships["assignee"]
+		if string(relationship) != scenario.expected || exists != (scenario.expected != "") {
+			t.Fatalf("%s: was expecting assignee %s, got %s", scenario.name, scenario.expected, relationship)
+		}
+
+		dst := new(Task)
+		if err := UnmarshalPayload(out, dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst.AssigneeTouched != scenario.task.AssigneeTouched {
+			t.Fatalf("%s: was expecting touched %v, got %v", scenario.name, scenario.task.AssigneeTouched, dst.AssigneeTouched)
+		}
+		if scenario.task.AssigneeTouched && (dst.Assignee == nil) != (scenario.task.Assignee == nil) {
+			t.Fatalf("%s: was expecting assignee %v, got %v", scenario.name, scenario.task.Assignee, dst.Assignee)
+		}
+	}
+}
+
+func TestTouchedAttributeRoundTrip(t *testing.T) {
+	notes := "call back"
+	scenarios := []struct {
+		name     string
+		task     *Task
+		expected string
+	}{
+		{"absent", &Task{ID: 1, Notes: &notes}, ""},
+		{"null", &Task{ID: 1, NotesTouched: true}, "null"},
+		{"set", &Task{ID: 1, Notes: &notes, NotesTouched: true}, `"call back"`},
+	}
+
+	for _, scenario := range scenarios {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, scenario.task); err != nil {
+			t.Fatal(err)
+		}
+
+		var document struct {
+			Data struct {
+				Attributes map[string]json.RawMessage `json:"attributes"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &document); err != nil {
+			t.Fatal(err)
+		}
+		attribute, exists := document.Data.Attributes["notes"]
+		if string(attribute) != scenario.expected || exists != (scenario.expected != "") {
+			t.Fatalf("%s: was expecting notes %s, got %s", scenario.name, scenario.expected, attribute)
+		}
+
+		dst := new(Task)
+		if err := UnmarshalPayload(out, dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst.NotesTouched != scenario.task.NotesTouched {
+			t.Fatalf("%s: was expecting touched %v, got %v", scenario.name, scenario.task.NotesTouched, dst.NotesTouched)
+		}
+		if scenario.task.NotesTouched && !reflect.DeepEqual(dst.Notes, scenario.task.Notes) {
+			t.Fatalf("%s: was expecting notes %v, got %v", scenario.name, scenario.task.Notes, dst.Notes)
+		}
+	}
+}
+
+func TestUnmarshalRelationshipsWithoutIncluded(t *testing.T) {
+	data, _ := payload(samplePayloadWithoutIncluded())
+	in := bytes.NewReader(data)
+	out := new(Post)
+
+	if err := UnmarshalPayload(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify each comment has at least an ID
+	for _, comment := range out.Comments {
+		if comment.ID == 0 {
+			t.Fatalf("The comment did not have an ID")
+		}
+	}
+}
+
+func TestUnmarshalRelationships(t *testing.T) {
+	out, err := unmarshalSamplePayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.CurrentPost == nil {
+		t.Fatalf("Current post was not materialized")
+	}
+
+	if out.CurrentPost.Title != "Bas" || out.CurrentPost.Body != "Fuubar" {
+		t.Fatalf("Attributes were not set")
+	}
+
+	if len(out.Posts) != 2 {
+		t.Fatalf("There should have been 2 posts")
+	}
+}
+
+func TestUnmarshalNullRelationship(t *testing.T) {
+	sample := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"attributes": map[string]interface{}{
+				"body":  "Hello",
+				"title": "World",
+			},
+			"relationships": map[string]interface{}{
+				"latest_comment": map[string]interface{}{
+					"data": nil, // empty to-one relationship
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := bytes.NewReader(data)
+	out := new(Post)
+
+	if err := UnmarshalPayload(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.LatestComment != nil {
+		t.Fatalf("Latest Comment was not set to nil")
+	}
+}
+
+func TestUnmarshalNullRelationshipInSlice(t *testing.T) {
+	sample := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"attributes": map[string]interface{}{
+				"body":  "Hello",
+				"title": "World",
+			},
+			"relationships": map[string]interface{}{
+				"comments": map[string]interface{}{
+					"data": []interface{}{}, // empty to-many relationships
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := bytes.NewReader(data)
+	out := new(Post)
+
+	if err := UnmarshalPayload(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Comments) != 0 {
+		t.Fatalf("Wrong number of comments; Comments should be empty")
+	}
+}
+
+func TestUnmarshalRelationshipsIntoPreallocatedSlice(t *testing.T) {
+	data, _ := payload(samplePayloadWithoutIncluded())
+	out := &Post{Comments: make([]*Comment, 0, 2)}
+	backing := reflect.ValueOf(out.Comments).Pointer()
+
+	// By default the caller's backing array is left alone
+	if err := UnmarshalPayload(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(out.Comments).Pointer() == backing {
+		t.Fatalf("Was expecting a new slice without WithPreallocatedRelations")
+	}
+
+	out = &Post{Comments: make([]*Comment, 0, 2)}
+	backing = reflect.ValueOf(out.Comments).Pointer()
+	if err := UnmarshalPayload(bytes.NewReader(data), out, WithPreallocatedRelations()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Comments) != 2 {
+		t.Fatalf("Wrong number of comments")
+	}
+	if reflect.ValueOf(out.Comments).Pointer() != backing {
+		t.Fatalf("Was expecting the preallocated backing array to be reused")
+	}
+	if out.Comments[0].ID != 123 || out.Comments[1].ID != 456 {
+		t.Fatalf("Comments were not set in order")
+	}
+}
+
+func TestUnmarshalNestedRelationships(t *testing.T) {
+	out, err := unmarshalSamplePayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.CurrentPost == nil {
+		t.Fatalf("Current post was not materialized")
+	}
+
+	if out.CurrentPost.Comments == nil {
+		t.Fatalf("Did not materialize nested records, comments")
+	}
+
+	if len(out.CurrentPost.Comments) != 2 {
+		t.Fatalf("Wrong number of comments")
+	}
+}
+
+func TestUnmarshalRelationshipsSerializedEmbedded(t *testing.T) {
+	out := sampleSerializedEmbeddedTestModel()
+
+	if out.CurrentPost == nil {
+		t.Fatalf("Current post was not materialized")
+	}
+
+	if out.CurrentPost.Title != "Foo" || out.CurrentPost.Body != "Bar" {
+		t.Fatalf("Attributes were not set")
+	}
+
+	if len(out.Posts) != 2 {
+		t.Fatalf("There should have been 2 posts")
+	}
+
+	if out.Posts[0].LatestComment.Body != "foo" {
+		t.Fatalf("The comment body was not set")
+	}
+}
+
+func TestUnmarshalNestedRelationshipsEmbedded(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalOnePayloadEmbedded(out, testModel()); err != nil {
+		t.Fatal(err)
+	}
+
+	model := new(Blog)
+
+	if err := UnmarshalPayload(out, model); err != nil {
+		t.Fatal(err)
+	}
+
+	if model.CurrentPost == nil {
+		t.Fatalf("Current post was not materialized")
+	}
+
+	if model.CurrentPost.Comments == nil {
+		t.Fatalf("Did not materialize nested records, comments")
+	}
+
+	if len(model.CurrentPost.Comments) != 2 {
+		t.Fatalf("Wrong number of comments")
+	}
+
+	if model.CurrentPost.Comments[0].Body != "foo" {
+		t.Fatalf("Comment body not set")
+	}
+}
+
+func TestUnmarshalRelationshipsSideloaded(t *testing.T) {
+	payload := samplePayloadWithSideloaded()
+	out := new(Blog)
+
+	if err := UnmarshalPayload(payload, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.CurrentPost == nil {
+		t.Fatalf("Current post was not materialized")
 	}
 
 	if out.CurrentPost.Title != "Foo" || out.CurrentPost.Body != "Bar" {
 		t.Fatalf("Attributes were not set")
 	}
 
-	if len(out.Posts) != 2 {
-		t.Fatalf("There should have been 2 posts")
+	if len(out.Posts) != 2 {
+		t.Fatalf("There should have been 2 posts")
+	}
+}
+
+func TestUnmarshalNestedRelationshipsSideloaded(t *testing.T) {
+	payload := samplePayloadWithSideloaded()
+	out := new(Blog)
+
+	if err := UnmarshalPayload(payload, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.CurrentPost == nil {
+		t.Fatalf("Current post was not materialized")
+	}
+
+	if out.CurrentPost.Comments == nil {
+		t.Fatalf("Did not materialize nested records, comments")
+	}
+
+	if len(out.CurrentPost.Comments) != 2 {
+		t.Fatalf("Wrong number of comments")
+	}
+
+	if out.CurrentPost.Comments[0].Body != "foo" {
+		t.Fatalf("Comment body not set")
+	}
+}
+
+func TestUnmarshalNestedRelationshipsEmbedded_withClientIDs(t *testing.T) {
+	model := new(Blog)
+
+	if err := UnmarshalPayload(samplePayload(), model); err != nil {
+		t.Fatal(err)
+	}
+
+	if model.Posts[0].ClientID == "" {
+		t.Fatalf("ClientID not set from request on related record")
+	}
+}
+
+func TestUnmarshalWithIDAsClientID(t *testing.T) {
+	body := `{"data": {"type": "comments", "id": "7", "attributes": {"body": "hi"}}}`
+
+	comment := new(Comment)
+	if err := UnmarshalPayload(strings.NewReader(body), comment); err != nil {
+		t.Fatal(err)
+	}
+	if comment.ClientID != "" {
+		t.Fatalf("Was expecting no client id by default, got %q", comment.ClientID)
+	}
+
+	comment = new(Comment)
+	if err := UnmarshalPayload(strings.NewReader(body), comment, WithIDAsClientID()); err != nil {
+		t.Fatal(err)
+	}
+	if comment.ID != 7 || comment.ClientID != "7" {
+		t.Fatalf("Was expecting id 7 and client id \"7\", got %d and %q", comment.ID, comment.ClientID)
+	}
+
+	// An explicit client id wins over the id
+	body = `{"data": {"type": "comments", "id": "7", "client-id": "tmp-1"}}`
+	comment = new(Comment)
+	if err := UnmarshalPayload(strings.NewReader(body), comment, WithIDAsClientID()); err != nil {
+		t.Fatal(err)
+	}
+	if comment.ClientID != "tmp-1" {
+		t.Fatalf("Was expecting client id \"tmp-1\", got %q", comment.ClientID)
+	}
+}
+
+func TestRelationIDs(t *testing.T) {
+	type PostWithIDs struct {
+		ID         int        `jsonapi:"primary,posts"`
+		Comments   []*Comment `jsonapi:"relation,comments,ids:CommentIDs"`
+		CommentIDs []string
+	}
+
+	data, _ := payload(samplePayloadWithoutIncluded())
+	out := new(PostWithIDs)
+	if err := UnmarshalPayload(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"123", "456"}, out.CommentIDs; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting comment ids %v, got %v", e, a)
+	}
+
+	// marshal builds the linkage from the ids when there are no models
+	buf := bytes.NewBuffer(nil)
+	in := &PostWithIDs{ID: 1, CommentIDs: []string{"7", "8"}}
+	if err := MarshalPayload(buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(buf).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	linkage := resp.Data.Relationships["comments"].(map[string]interface{})["data"].([]interface{})
+	if len(linkage) != 2 {
+		t.Fatalf("Was expecting 2 comment linkages, got %d", len(linkage))
+	}
+	for i, id := range in.CommentIDs {
+		l := linkage[i].(map[string]interface{})
+		if l["type"] != "comments" || l["id"] != id {
+			t.Fatalf("Was expecting linkage comments/%s, got %v", id, l)
+		}
+	}
+	if len(resp.Included) != 0 {
+		t.Fatal("Was not expecting id-only linkage to be sideloaded")
+	}
+}
+
+func TestRelationIDsOnly(t *testing.T) {
+	type PostWithIDs struct {
+		ID         int        `jsonapi:"primary,posts"`
+		Comments   []*Comment `jsonapi:"relation,comments,ids:CommentIDs,idsonly"`
+		CommentIDs []string
+		Author     *Author `jsonapi:"relation,author,ids:AuthorIDs,idsonly"`
+		AuthorIDs  []string
+	}
+
+	body := `{"data": {"type": "posts", "id": "1", "relationships": {
+		"comments": {"data": [{"type": "comments", "id": "1"}, {"type": "comments", "id": "2"}]},
+		"author": {"data": {"type": "authors", "id": "3"}}
+	}}, "included": [{"type": "comments", "id": "1", "attributes": {"body": "foo"}}]}`
+
+	out := new(PostWithIDs)
+	if err := UnmarshalPayload(strings.NewReader(body), out); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"1", "2"}, out.CommentIDs; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting comment ids %v, got %v", e, a)
+	}
+	if e, a := []string{"3"}, out.AuthorIDs; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting author ids %v, got %v", e, a)
+	}
+	if out.Comments != nil || out.Author != nil {
+		t.Fatalf("Was expecting no related models, got %v and %v", out.Comments, out.Author)
+	}
+
+	// marshal builds the linkage from the ids even with models present
+	in := &PostWithIDs{ID: 1, Comments: []*Comment{{ID: 5}}, CommentIDs: []string{"7"}}
+	payload, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkage := payload.(*OnePayload).Data.Relationships["comments"].(*RelationshipManyNode).Data
+	if len(linkage) != 1 || linkage[0].ID != "7" {
+		t.Fatalf("Was expecting the linkage from the ids, got %v", linkage)
+	}
+	if len(payload.(*OnePayload).Included) != 0 {
+		t.Fatal("Was not expecting id-only linkage to be sideloaded")
+	}
+
+	// a to-one relationship round trips through its single id
+	buf := bytes.NewBuffer(nil)
+	if err := MarshalPayload(buf, out); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := new(PostWithIDs)
+	if err := UnmarshalPayload(buf, roundTrip); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"3"}, roundTrip.AuthorIDs; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting author ids %v after a round trip, got %v", e, a)
+	}
+
+	in.AuthorIDs = []string{"3", "4"}
+	if _, err := Marshal(in); !errors.Is(err, ErrInvalidRelationship) {
+		t.Fatalf("Was expecting ErrInvalidRelationship for two to-one ids, got %v", err)
+	}
+
+	type badPost struct {
+		ID       int        `jsonapi:"primary,posts"`
+		Comments []*Comment `jsonapi:"relation,comments,idsonly"`
+	}
+	if err := UnmarshalPayload(strings.NewReader(body), new(badPost)); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag without an ids field, got %v", err)
+	}
+}
+
+func TestUnmarshalDuplicateIncluded(t *testing.T) {
+	sample := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"relationships": map[string]interface{}{
+				"latest_comment": map[string]interface{}{
+					"data": map[string]interface{}{"type": "comments", "id": "1"},
+				},
+			},
+		},
+		"included": []interface{}{
+			map[string]interface{}{
+				"type":       "comments",
+				"id":         "1",
+				"attributes": map[string]interface{}{"body": "first"},
+			},
+			map[string]interface{}{
+				"type":       "comments",
+				"id":         "1",
+				"attributes": map[string]interface{}{"body": "second"},
+			},
+		},
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(Post)
+	if err := UnmarshalPayload(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "second", out.LatestComment.Body; e != a {
+		t.Fatalf("Was expecting the last included duplicate %s to win, got %s", e, a)
+	}
+
+	err = UnmarshalPayload(bytes.NewReader(data), new(Post), WithRejectDuplicateIncluded())
+	if !errors.Is(err, ErrDuplicateIncluded) {
+		t.Fatalf("Was expecting ErrDuplicateIncluded, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "(comments,1)") {
+		t.Fatalf("Was expecting the error to name the duplicate, got %s", err)
+	}
+}
+
+func TestUnmarshalCaseInsensitiveTypes(t *testing.T) {
+	sample := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "posts",
+			"id":   "1",
+			"relationships": map[string]interface{}{
+				"latest_comment": map[string]interface{}{
+					"data": map[string]interface{}{"type": "comments", "id": "1"},
+				},
+			},
+		},
+		"included": []interface{}{
+			map[string]interface{}{
+				"type":       "Comments",
+				"id":         "1",
+				"attributes": map[string]interface{}{"body": "included"},
+			},
+		},
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(Post)
+	if err := UnmarshalPayload(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.LatestComment.Body != "" {
+		t.Fatalf("Was expecting types to be case sensitive by default, got %s", out.LatestComment.Body)
+	}
+
+	out = new(Post)
+	if err := UnmarshalPayload(bytes.NewReader(data), out, WithCaseInsensitiveTypes()); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "included", out.LatestComment.Body; e != a {
+		t.Fatalf("Was expecting the included comment body %s, got %s", e, a)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	scenarios := []struct {
+		body     string
+		expected PayloadKind
+	}{
+		{`{"data": {"type": "posts", "id": "1"}}`, PayloadKindOne},
+		{`{"data": null}`, PayloadKindOne},
+		{`{"data": [{"type": "posts", "id": "1"}]}`, PayloadKindMany},
+		{`{"errors": [{"title": "Not Found"}]}`, PayloadKindErrors},
+		{`{"meta": {"count": 0}}`, PayloadKindUnknown},
+	}
+
+	for _, scenario := range scenarios {
+		kind, replay, err := Probe(strings.NewReader(scenario.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != scenario.expected {
+			t.Fatalf("Was expecting kind %d for %s, got %d", scenario.expected, scenario.body, kind)
+		}
+
+		replayed, err := ioutil.ReadAll(replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(replayed) != scenario.body {
+			t.Fatalf("Was expecting the reader to replay %s, got %s", scenario.body, replayed)
+		}
+	}
+
+	kind, replay, err := Probe(samplePayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != PayloadKindOne {
+		t.Fatalf("Was expecting kind %d, got %d", PayloadKindOne, kind)
+	}
+	if err := UnmarshalPayload(replay, new(Blog)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Probe(strings.NewReader("not json")); err == nil {
+		t.Fatal("Was expecting an error for an invalid document")
+	}
+}
+
+func TestDocumentVersion(t *testing.T) {
+	scenarios := []struct {
+		body     string
+		expected string
+	}{
+		{`{"jsonapi": {"version": "1.1"}, "data": null}`, "1.1"},
+		{`{"jsonapi": {"meta": {"build": "abc"}}, "data": null}`, "1.0"},
+		{`{"data": null}`, "1.0"},
+	}
+
+	for _, scenario := range scenarios {
+		version, err := DocumentVersion(strings.NewReader(scenario.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != scenario.expected {
+			t.Fatalf("Was expecting version %s for %s, got %s", scenario.expected, scenario.body, version)
+		}
+	}
+}
+
+func TestUnmarshalManyPayloadKeepsJSONAPIObject(t *testing.T) {
+	body := `{"jsonapi": {"version": "1.1", "ext": ["https://jsonapi.org/ext/atomic"]}, "data": {"type": "posts", "id": "1"}}`
+
+	payload, err := decodeManyPayload(strings.NewReader(body), newOptions([]Option{WithSingleResourceAsMany()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.JSONAPI == nil || payload.JSONAPI.Version != "1.1" || len(payload.JSONAPI.Ext) != 1 {
+		t.Fatalf("Was expecting the jsonapi object to be decoded, got %#v", payload.JSONAPI)
+	}
+}
+
+func TestUnmarshalNullData(t *testing.T) {
+	body := `{"data": null, "meta": {"reason": "not found"}}`
+
+	if err := UnmarshalPayload(strings.NewReader(body), new(Blog)); err != ErrNullData {
+		t.Fatalf("Was expecting ErrNullData, got %v", err)
+	}
+
+	out := &Blog{Title: "untouched"}
+	if err := UnmarshalPayload(strings.NewReader(body), out, WithNullDataAllowed()); err != nil {
+		t.Fatal(err)
+	}
+	if out.Title != "untouched" {
+		t.Fatalf("Was expecting the model to be left untouched, got %#v", out)
+	}
+}
+
+func TestUnmarshalResourceIdentifierOnly(t *testing.T) {
+	body := `{"data": {"type": "blogs", "id": "5"}}`
+
+	out := &Blog{Title: "untouched", ViewCount: 3}
+	if err := UnmarshalPayload(strings.NewReader(body), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != 5 {
+		t.Fatalf("Was expecting id 5, got %d", out.ID)
+	}
+	if out.Title != "untouched" || out.ViewCount != 3 {
+		t.Fatalf("Was expecting the attributes to be left untouched, got %#v", out)
+	}
+
+	many := `{"data": [{"type": "blogs", "id": "5"}, {"type": "blogs", "id": "6"}]}`
+	blogs, err := UnmarshalManyPayload(strings.NewReader(many), reflect.TypeOf(new(Blog)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blogs) != 2 || blogs[1].(*Blog).ID != 6 {
+		t.Fatalf("Was expecting two blogs identified by id, got %v", blogs)
+	}
+}
+
+func TestUnmarshalLinkageMeta(t *testing.T) {
+	owner := &Member{ID: 1, Name: "Ann", Role: "admin"}
+	group := &Group{
+		ID:      1,
+		Owner:   owner,
+		Members: []*Member{owner, {ID: 2, Name: "Bob", Role: "member"}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, group); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(Group)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(group, dst) {
+		t.Fatalf("Was expecting the linkage roles to be read back, got %#v %#v %#v",
+			dst.Owner, dst.Members[0], dst.Members[1])
 	}
 }
 
-func TestUnmarshalNestedRelationshipsSideloaded(t *testing.T) {
-	payload := samplePayloadWithSideloaded()
-	out := new(Blog)
+func TestUnmarshalRelationshipMeta(t *testing.T) {
+	body := `{"data": {"type": "memberships", "id": "1", "relationships": {
+		"owner": {"data": {"type": "users", "id": "1"}, "meta": {"since": "2020"}},
+		"members": {"data": [{"type": "users", "id": "2"}]}
+	}}}`
 
-	if err := UnmarshalPayload(payload, out); err != nil {
+	dst := new(Membership)
+	if err := UnmarshalPayload(strings.NewReader(body), dst); err != nil {
 		t.Fatal(err)
 	}
 
-	if out.CurrentPost == nil {
-		t.Fatalf("Current post was not materialized")
+	if meta := dst.RelationMeta["owner"]; meta == nil || (*meta)["since"] != "2020" {
+		t.Fatalf("Was expecting the owner relationship meta, got %v", dst.RelationMeta)
+	}
+	if _, exists := dst.RelationMeta["members"]; exists {
+		t.Fatal("Was expecting no meta for the members relationship")
+	}
+	if dst.Owner == nil || dst.Owner.ID != 1 || len(dst.Members) != 1 {
+		t.Fatalf("Was expecting the relationships to be unmarshaled, got %#v", dst)
 	}
 
-	if out.CurrentPost.Comments == nil {
-		t.Fatalf("Did not materialize nested records, comments")
+	// Models without the interface are unaffected
+	group := new(Group)
+	if err := UnmarshalPayload(strings.NewReader(strings.Replace(body, "memberships", "groups", 1)), group); err != nil {
+		t.Fatal(err)
 	}
+	if group.Owner == nil || group.Owner.ID != 1 {
+		t.Fatalf("Was expecting the owner to be unmarshaled, got %#v", group.Owner)
+	}
+}
 
-	if len(out.CurrentPost.Comments) != 2 {
-		t.Fatalf("Wrong number of comments")
+func TestUnmarshalPolymorphicToMany(t *testing.T) {
+	feed := &Feed{
+		ID: 1,
+		Items: []interface{}{
+			&Post{ID: 2, Title: "Foo", Body: "Bar"},
+			&Page{ID: 3, Title: "About Us"},
+		},
 	}
 
-	if out.CurrentPost.Comments[0].Body != "foo" {
-		t.Fatalf("Comment body not set")
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, feed); err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+
+	registry := NewTypeRegistry()
+	registry.RegisterType("posts", (*Post)(nil))
+	registry.RegisterType("pages", (*Page)(nil))
+
+	dst := new(Feed)
+	if err := UnmarshalPayload(bytes.NewReader(data), dst, WithTypeRegistry(registry)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dst.Items) != 2 {
+		t.Fatalf("Was expecting 2 items, got %d", len(dst.Items))
+	}
+	post, ok := dst.Items[0].(*Post)
+	if !ok || post.ID != 2 || post.Title != "Foo" {
+		t.Fatalf("Was expecting the first item to be post 2, got %#v", dst.Items[0])
+	}
+	page, ok := dst.Items[1].(*Page)
+	if !ok || page.ID != 3 || page.Slug != "about-us" {
+		t.Fatalf("Was expecting the second item to be page 3, got %#v", dst.Items[1])
+	}
+
+	err := UnmarshalPayload(bytes.NewReader(data), new(Feed))
+	if !errors.Is(err, ErrUnregisteredType) {
+		t.Fatalf("Was expecting ErrUnregisteredType without a registry, got %v", err)
 	}
 }
 
-func TestUnmarshalNestedRelationshipsEmbedded_withClientIDs(t *testing.T) {
-	model := new(Blog)
+func TestUnmarshalPolymorphicToOne(t *testing.T) {
+	registry := NewTypeRegistry()
+	registry.RegisterType("authors", (*Author)(nil))
+	registry.RegisterType("blogs", (*Blog)(nil))
+	registry.RegisterType("comments", (*Comment)(nil))
 
-	if err := UnmarshalPayload(samplePayload(), model); err != nil {
+	for _, publisher := range []Publisher{&Author{ID: 1, Name: "Ann"}, &Blog{ID: 2, Title: "Ann's blog"}} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, &Feed{ID: 1, Publisher: publisher}); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := new(Feed)
+		if err := UnmarshalPayload(out, dst, WithTypeRegistry(registry)); err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(dst.Publisher) != reflect.TypeOf(publisher) || dst.Publisher.PublisherName() != publisher.PublisherName() {
+			t.Fatalf("Was expecting publisher %#v, got %#v", publisher, dst.Publisher)
+		}
+	}
+
+	body := `{"data": {"type": "feeds", "id": "1", "relationships": {"publisher": {"data": {"type": "comments", "id": "3"}}}}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(Feed), WithTypeRegistry(registry)); err != ErrInvalidType {
+		t.Fatalf("Was expecting ErrInvalidType for a type not implementing the field's interface, got %v", err)
+	}
+}
+
+func TestUnmarshalDeepIncludedGraph(t *testing.T) {
+	linkage := func(nodeType string, ids ...string) map[string]interface{} {
+		data := []interface{}{}
+		for _, id := range ids {
+			data = append(data, map[string]interface{}{"type": nodeType, "id": id})
+		}
+		return map[string]interface{}{"data": data}
+	}
+
+	// Every level only links to the next, so each one must be resolved
+	// against included
+	sample := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":          "blogs",
+			"id":            "1",
+			"attributes":    map[string]interface{}{"title": "Blog"},
+			"relationships": map[string]interface{}{"posts": linkage("posts", "10", "11")},
+		},
+		"included": []interface{}{
+			map[string]interface{}{
+				"type":          "posts",
+				"id":            "10",
+				"attributes":    map[string]interface{}{"title": "First"},
+				"relationships": map[string]interface{}{"comments": linkage("comments", "100", "101")},
+			},
+			map[string]interface{}{
+				"type":          "posts",
+				"id":            "11",
+				"attributes":    map[string]interface{}{"title": "Second"},
+				"relationships": map[string]interface{}{"comments": linkage("comments", "101")},
+			},
+			map[string]interface{}{
+				"type":       "comments",
+				"id":         "100",
+				"attributes": map[string]interface{}{"body": "one hundred"},
+			},
+			map[string]interface{}{
+				"type":       "comments",
+				"id":         "101",
+				"attributes": map[string]interface{}{"body": "one hundred and one"},
+			},
+		},
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if model.Posts[0].ClientID == "" {
-		t.Fatalf("ClientID not set from request on related record")
+	out := new(Blog)
+	if err := UnmarshalPayload(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Posts) != 2 || out.Posts[0].Title != "First" || out.Posts[1].Title != "Second" {
+		t.Fatalf("Was expecting the posts to be resolved, got %#v", out.Posts)
+	}
+	expected := [][]string{{"one hundred", "one hundred and one"}, {"one hundred and one"}}
+	for i, post := range out.Posts {
+		var bodies []string
+		for _, c := range post.Comments {
+			bodies = append(bodies, c.Body)
+		}
+		if !reflect.DeepEqual(expected[i], bodies) {
+			t.Fatalf("Was expecting post %d comments %v, got %v", post.ID, expected[i], bodies)
+		}
 	}
 }
 
@@ -575,6 +2132,213 @@ func unmarshalSamplePayload() (*Blog, error) {
 	return out, nil
 }
 
+func TestUnmarshalRelationshipTypeMismatch(t *testing.T) {
+	body := `{
+		"data": {"type": "posts", "id": "1", "relationships": {
+			"comments": {"data": [{"type": "notes", "id": "2"}]}
+		}},
+		"included": [{"type": "notes", "id": "2", "attributes": {"body": "hi"}}]
+	}`
+
+	err := UnmarshalPayload(strings.NewReader(body), new(Post))
+	if !errors.Is(err, ErrRelationshipTypeMismatch) {
+		t.Fatalf("Was expecting ErrRelationshipTypeMismatch, got %v", err)
+	}
+	if e := `relationship "comments" expects "comments", got "notes"`; !strings.Contains(err.Error(), e) {
+		t.Fatalf("Was expecting the error to mention %s, got %v", e, err)
+	}
+
+	post := new(Post)
+	if err := UnmarshalPayload(strings.NewReader(body), post, WithLenientRelationshipTypes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(post.Comments) != 1 || post.Comments[0].ID != 2 || post.Comments[0].Body != "hi" {
+		t.Fatalf("Was expecting the note to be unmarshaled as a comment, got %#v", post.Comments)
+	}
+}
+
+func TestRelationshipIterator(t *testing.T) {
+	body := `{
+		"data": {"type": "posts", "id": "1", "relationships": {
+			"comments": {"data": [
+				{"type": "comments", "id": "1"},
+				{"type": "comments", "id": "2"},
+				{"type": "comments", "id": "3"}
+			]}
+		}},
+		"included": [
+			{"type": "comments", "id": "1", "attributes": {"body": "first"}},
+			{"type": "comments", "id": "2", "attributes": {"body": "second"}}
+		]
+	}`
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal([]byte(body), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, err := RelationshipIterator(payload.Data, "comments", (*Comment)(nil), payload.Included)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	seq(func(model interface{}, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		comment := model.(*Comment)
+		bodies = append(bodies, fmt.Sprintf("%d:%s", comment.ID, comment.Body))
+		return true
+	})
+	if e := []string{"1:first", "2:second", "3:"}; !reflect.DeepEqual(e, bodies) {
+		t.Fatalf("Was expecting %v, got %v", e, bodies)
+	}
+
+	// Iteration stops as soon as yield returns false
+	var count int
+	seq(func(model interface{}, err error) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("Was expecting iteration to stop after 1 model, got %d", count)
+	}
+
+	seq, err = RelationshipIterator(payload.Data, "missing", (*Comment)(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq(func(model interface{}, err error) bool {
+		t.Fatalf("Was expecting no models, got %v", model)
+		return true
+	})
+
+	if _, err := RelationshipIterator(payload.Data, "comments", Comment{}, nil); err != ErrUnexpectedType {
+		t.Fatalf("Was expecting ErrUnexpectedType, got %v", err)
+	}
+
+	// Members are type checked like relationship fields
+	seq, err = RelationshipIterator(payload.Data, "comments", (*Post)(nil), payload.Included)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var iterErr error
+	seq(func(model interface{}, err error) bool {
+		iterErr = err
+		return err == nil
+	})
+	if !errors.Is(iterErr, ErrRelationshipTypeMismatch) {
+		t.Fatalf("Was expecting ErrRelationshipTypeMismatch, got %v", iterErr)
+	}
+}
+
+func TestRelationshipIteratorCycle(t *testing.T) {
+	body := `{
+		"data": {"type": "categories", "id": "1", "relationships": {
+			"children": {"data": [{"type": "categories", "id": "2"}]}
+		}},
+		"included": [
+			{"type": "categories", "id": "1", "attributes": {"name": "Root"}},
+			{"type": "categories", "id": "2", "attributes": {"name": "Child"},
+				"relationships": {"parent": {"data": {"type": "categories", "id": "1"}}}}
+		]
+	}`
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal([]byte(body), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, err := RelationshipIterator(payload.Data, "children", (*Category)(nil), payload.Included)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var children []*Category
+	seq(func(model interface{}, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, model.(*Category))
+		return true
+	})
+
+	// The link back to the iterated resource is not resolved
+	if len(children) != 1 || !reflect.DeepEqual(children[0].Parent, &Category{ID: 1}) {
+		t.Fatalf("Was expecting the child's parent to be only linked, got %#v", children)
+	}
+}
+
+func TestUnmarshalIncludedCycle(t *testing.T) {
+	body := `{
+		"data": {"type": "categories", "id": "3", "attributes": {"name": "Leaf"},
+			"relationships": {"parent": {"data": {"type": "categories", "id": "1"}}}},
+		"included": [
+			{"type": "categories", "id": "1", "attributes": {"name": "First"},
+				"relationships": {"parent": {"data": {"type": "categories", "id": "2"}}}},
+			{"type": "categories", "id": "2", "attributes": {"name": "Second"},
+				"relationships": {"parent": {"data": {"type": "categories", "id": "1"}}}}
+		]
+	}`
+
+	leaf := new(Category)
+	if err := UnmarshalPayload(strings.NewReader(body), leaf); err != nil {
+		t.Fatal(err)
+	}
+
+	first := leaf.Parent
+	if first == nil || first.Name != "First" {
+		t.Fatalf("Was expecting the first category, got %#v", first)
+	}
+	second := first.Parent
+	if second == nil || second.Name != "Second" {
+		t.Fatalf("Was expecting the second category, got %#v", second)
+	}
+
+	// The cycle back to the first category is only linked
+	if e, a := (&Category{ID: 1}), second.Parent; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting %#v, got %#v", e, a)
+	}
+}
+
+func TestRelationshipCursor(t *testing.T) {
+	body := `{"data": {"type": "blogs", "id": "1", "relationships": {
+		"posts": {
+			"data": [{"type": "posts", "id": "1"}],
+			"links": {"next": "/blogs/1/relationships/posts?page[cursor]=abc"}
+		},
+		"comments": {
+			"data": [{"type": "comments", "id": "1"}],
+			"links": {"next": {"href": "/blogs/1/comments?page=2"}}
+		},
+		"tags": {"data": [], "meta": {"cursor": "xyz"}},
+		"owner": {"data": null}
+	}}}`
+
+	payload := new(OnePayload)
+	if err := json.Unmarshal([]byte(body), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, expected := range map[string]string{
+		"posts":    "/blogs/1/relationships/posts?page[cursor]=abc",
+		"comments": "/blogs/1/comments?page=2",
+		"tags":     "xyz",
+	} {
+		next, ok := RelationshipCursor(payload.Data, rel)
+		if !ok || next != expected {
+			t.Fatalf("Was expecting %q for %s, got %q (%v)", expected, rel, next, ok)
+		}
+	}
+
+	for _, rel := range []string{"owner", "missing"} {
+		if next, ok := RelationshipCursor(payload.Data, rel); ok {
+			t.Fatalf("Was expecting no cursor for %s, got %q", rel, next)
+		}
+	}
+}
+
 func TestUnmarshalManyPayload(t *testing.T) {
 	sample := map[string]interface{}{
 		"data": []interface{}{
@@ -620,6 +2384,231 @@ func TestUnmarshalManyPayload(t *testing.T) {
 	}
 }
 
+func TestPromotedEmbeddedFieldsRoundTrip(t *testing.T) {
+	folder := &Folder{
+		Base:  Base{Name: "base", Owner: &Author{ID: 5, Name: "ann"}},
+		Audit: &Audit{Revision: 3},
+		ID:    1,
+		Name:  "docs",
+	}
+
+	payload, err := Marshal(folder, WithPromotedEmbeddedFields())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := payload.(*OnePayload).Data
+	if data.Type != "folders" || data.ID != "1" {
+		t.Fatalf("Was expecting the outer type and id, got %s,%s", data.Type, data.ID)
+	}
+	if e, a := (map[string]interface{}{"name": "docs", "revision": 3}), data.Attributes; !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting attributes %v, got %v", e, a)
+	}
+	if _, ok := data.Relationships["owner"]; !ok {
+		t.Fatal("Was expecting the promoted owner relationship")
+	}
+
+	// Without the option the embedded structs are ignored
+	payload, err = Marshal(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := payload.(*OnePayload).Data; len(data.Attributes) != 1 || data.Relationships != nil {
+		t.Fatalf("Was expecting only the outer fields, got %v and %v", data.Attributes, data.Relationships)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, folder, WithPromotedEmbeddedFields()); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(Folder)
+	if err := UnmarshalPayload(out, dst, WithPromotedEmbeddedFields()); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Name != "docs" || dst.Base.Name != "" {
+		t.Fatalf("Was expecting the outer name to win, got %q and %q", dst.Name, dst.Base.Name)
+	}
+	if dst.Audit == nil || dst.Revision != 3 {
+		t.Fatalf("Was expecting the embedded pointer to be allocated, got %#v", dst.Audit)
+	}
+	if dst.Owner == nil || dst.Owner.Name != "ann" {
+		t.Fatalf("Was expecting the promoted owner, got %#v", dst.Owner)
+	}
+}
+
+func TestAttributeKeyPrefixRoundTrip(t *testing.T) {
+	post := &Post{
+		ID:       1,
+		Title:    "Title",
+		Body:     "Body",
+		Comments: []*Comment{{ID: 2, Body: "first"}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, post, WithAttributeKeyPrefix("acme:")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"acme:title":"Title"`, `"acme:body":"first"`} {
+		if !strings.Contains(out.String(), key) {
+			t.Fatalf("Was expecting %s in %s", key, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `"title"`) {
+		t.Fatalf("Was expecting no unprefixed keys, got %s", out.String())
+	}
+
+	raw := out.Bytes()
+	dst := new(Post)
+	if err := UnmarshalPayload(bytes.NewReader(raw), dst, WithAttributeKeyPrefix("acme:")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(post, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", post, dst)
+	}
+
+	// Without the option the prefixed keys don't match
+	dst = new(Post)
+	if err := UnmarshalPayload(bytes.NewReader(raw), dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Title != "" {
+		t.Fatalf("Was expecting no title, got %q", dst.Title)
+	}
+
+	// Unprefixed keys still match by their literal name
+	body := `{"data": {"type": "posts", "id": "1", "attributes": {"title": "Plain", "acme:body": "Prefixed"}}}`
+	dst = new(Post)
+	if err := UnmarshalPayload(strings.NewReader(body), dst, WithAttributeKeyPrefix("acme:")); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Title != "Plain" || dst.Body != "Prefixed" {
+		t.Fatalf("Was expecting both keys to match, got %q and %q", dst.Title, dst.Body)
+	}
+}
+
+func TestMapRelationRoundTrip(t *testing.T) {
+	discussion := &Discussion{
+		ID: 1,
+		Comments: map[string]*Comment{
+			"3": {ID: 3, Body: "third"},
+			"2": {ID: 2, Body: "second"},
+		},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, discussion); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(Discussion)
+	if err := UnmarshalPayload(out, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(discussion, dst) {
+		t.Fatalf("Was expecting %#v, got %#v", discussion, dst)
+	}
+
+	type badDiscussion struct {
+		ID       int              `jsonapi:"primary,discussions"`
+		Comments map[int]*Comment `jsonapi:"relation,comments,map"`
+	}
+	body := `{"data": {"type": "discussions", "id": "1", "relationships": {"comments": {"data": [{"type": "comments", "id": "2"}]}}}}`
+	if err := UnmarshalPayload(strings.NewReader(body), new(badDiscussion)); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag for a map not keyed by strings, got %v", err)
+	}
+
+	type valueDiscussion struct {
+		ID       int                `jsonapi:"primary,discussions"`
+		Comments map[string]Comment `jsonapi:"relation,comments,map"`
+	}
+	if err := UnmarshalPayload(strings.NewReader(body), new(valueDiscussion)); err != ErrBadJSONAPIStructTag {
+		t.Fatalf("Was expecting ErrBadJSONAPIStructTag for a map of struct values, got %v", err)
+	}
+
+	for _, data := range []string{
+		`[{"type": "comments", "id": "2"}, {"type": "comments", "id": "2"}]`,
+		`[{"type": "comments", "lid": "a"}, {"type": "comments", "lid": "b"}]`,
+	} {
+		body := `{"data": {"type": "discussions", "id": "1", "relationships": {"comments": {"data": ` + data + `}}}}`
+		if err := UnmarshalPayload(strings.NewReader(body), new(Discussion)); !errors.Is(err, ErrInvalidRelationKey) {
+			t.Fatalf("Was expecting ErrInvalidRelationKey for %s, got %v", data, err)
+		}
+	}
+}
+
+func TestUnmarshalManyPayloadInto(t *testing.T) {
+	body := `{"data": [
+		{"type": "posts", "id": "1", "attributes": {"title": "First"}},
+		{"type": "posts", "id": "2", "attributes": {"title": "Second"}}
+	]}`
+
+	var posts []*Post
+	if err := UnmarshalManyPayloadInto(strings.NewReader(body), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 || posts[0].ID != 1 || posts[1].Title != "Second" {
+		t.Fatalf("Was expecting the posts to be unmarshaled, got %#v", posts)
+	}
+
+	for _, out := range []interface{}{posts, &[]Post{}, new(Post), new([]string), (*[]*Post)(nil)} {
+		if err := UnmarshalManyPayloadInto(strings.NewReader(body), out); err != ErrUnexpectedType {
+			t.Fatalf("Was expecting ErrUnexpectedType for %T, got %v", out, err)
+		}
+	}
+}
+
+func TestUnmarshalPayloadWithBOM(t *testing.T) {
+	body := "\uFEFF \r\n" + `{"data": {"type": "posts", "id": "1", "attributes": {"title": "Title"}}}`
+
+	post := new(Post)
+	if err := UnmarshalPayload(strings.NewReader(body), post); err != nil {
+		t.Fatal(err)
+	}
+	if post.ID != 1 || post.Title != "Title" {
+		t.Fatalf("Was expecting the post to be unmarshaled, got %#v", post)
+	}
+
+	many := "\uFEFF" + `{"data": [{"type": "posts", "id": "1"}, {"type": "posts", "id": "2"}]}`
+	posts, err := UnmarshalManyPayload(strings.NewReader(many), reflect.TypeOf(new(Post)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("Was expecting 2 posts, got %d", len(posts))
+	}
+
+	if err := UnmarshalPayload(strings.NewReader("\uFEFF"), new(Post)); err != io.EOF {
+		t.Fatalf("Was expecting io.EOF for a body of only a BOM, got %v", err)
+	}
+}
+
+func TestUnmarshalManyPayload_singleResource(t *testing.T) {
+	data, err := json.Marshal(samplePayloadWithoutIncluded())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UnmarshalManyPayload(bytes.NewReader(data), reflect.TypeOf(new(Post))); err == nil {
+		t.Fatal("Was expecting an error decoding a single resource as many")
+	}
+
+	posts, err := UnmarshalManyPayload(
+		bytes.NewReader(data),
+		reflect.TypeOf(new(Post)),
+		WithSingleResourceAsMany(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 1 {
+		t.Fatalf("Was expecting 1 post, got %d", len(posts))
+	}
+	if post := posts[0].(*Post); post.ID != 1 || post.Title != "World" {
+		t.Fatalf("Unexpected post %+v", post)
+	}
+}
+
 func TestManyPayload_withLinks(t *testing.T) {
 	firstPageURL := "http://somesite.com/movies?page[limit]=50&page[offset]=50"
 	prevPageURL := "http://somesite.com/movies?page[limit]=50&page[offset]=0"
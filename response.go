@@ -1,13 +1,17 @@
 package jsonapi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,14 +33,43 @@ var (
 	// ErrEmbeddedPtrNotSet is returned when marshalling an interface with an embedded interface
 	// the embedded interface must not be null or this error is returned
 	ErrEmbeddedPtrNotSet = errors.New("embedded pointer is nil")
+	// ErrInvalidRelationship is returned when a relationship given to
+	// MarshalPayloadWithExtraRelationships isn't a relationship node whose
+	// linkage all has a type and id.
+	ErrInvalidRelationship = errors.New("relationship should be a *RelationshipOneNode or *RelationshipManyNode with typed and identified linkage")
+	// ErrIncludedTooLarge is returned, wrapped with the counts, when "included"
+	// would hold more resources than WithMaxIncludedCount allows.
+	ErrIncludedTooLarge = errors.New("included holds more resources than allowed")
 )
 
+// MarshalError is returned when marshalling a collection fails, identifying
+// the offending model by its index in the collection and, when they could be
+// determined, its type and id. Err holds the underlying error.
+type MarshalError struct {
+	Index int
+	Type  string
+	ID    string
+	Err   error
+}
+
+// Error implements the `error` interface.
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("jsonapi: marshalling model %d (%s,%s): %v", e.Index, e.Type, e.ID, e.Err)
+}
+
+// Unwrap returns the underlying error so it can be matched with errors.Is.
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
 type fieldbuilder struct {
 	model interface{}
 
 	node     *Node
 	included *map[string]*Node
 	sideload bool
+	depth    int
+	opts     *options
 
 	annotation string
 	nodeType   string
@@ -83,19 +116,236 @@ type fieldbuilder struct {
 //		 }
 //	 }
 //
-func MarshalPayload(w io.Writer, models interface{}) error {
-	payload, err := Marshal(models)
+func MarshalPayload(w io.Writer, models interface{}, opts ...Option) error {
+	payload, err := Marshal(models, opts...)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(payload)
+}
+
+// MarshalPayloadFiltered writes a jsonapi collection response like
+// MarshalPayload, leaving out the elements of models for which keep returns
+// false, e.g. soft-deleted records. models must be a slice of struct pointers.
+func MarshalPayloadFiltered(w io.Writer, models interface{},
+	keep func(model interface{}) bool, opts ...Option) error {
+	vals := reflect.ValueOf(models)
+	if vals.Kind() != reflect.Slice {
+		return ErrExpectedSlice
+	}
+
+	// The filtered slice keeps the type of models so that a Linkable or
+	// Metable collection type still applies
+	kept := reflect.MakeSlice(vals.Type(), 0, vals.Len())
+	for i := 0; i < vals.Len(); i++ {
+		if keep(vals.Index(i).Interface()) {
+			kept = reflect.Append(kept, vals.Index(i))
+		}
+	}
+
+	return MarshalPayload(w, kept.Interface(), opts...)
+}
+
+// MarshalPayloadWithTotal writes a jsonapi collection response like
+// MarshalPayload, adding the total number of resources, e.g. across all pages,
+// as the "total-count" top-level meta. It is merged with the meta of a Metable
+// collection type. models must be a slice of struct pointers.
+func MarshalPayloadWithTotal(w io.Writer, models interface{}, total int, opts ...Option) error {
+	payload, err := Marshal(models, opts...)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := payload.(*ManyPayload); !ok {
+		return ErrExpectedSlice
+	}
+	mergeMeta(payload, Meta{KeyTotalCount: total})
+
+	return json.NewEncoder(w).Encode(payload)
+}
+
+// MarshalPayloadWithMetaFunc writes a jsonapi response like MarshalPayload,
+// computing the top-level meta from the models with metaFn, e.g. the range of
+// a field across the page. It is merged over the meta of a Metable collection
+// type; a nil result adds nothing.
+func MarshalPayloadWithMetaFunc(w io.Writer, models interface{},
+	metaFn func(models interface{}) *Meta, opts ...Option) error {
+	payload, err := Marshal(models, opts...)
 	if err != nil {
 		return err
 	}
 
+	if meta := metaFn(models); meta != nil {
+		mergeMeta(payload, *meta)
+	}
+
 	return json.NewEncoder(w).Encode(payload)
 }
 
+// MarshalPayloadWithResourceMeta writes a jsonapi response like
+// MarshalPayload, computing additional meta for every resource, included ones
+// too, with metaFn, e.g. per-request permissions. A resource's meta merges, in
+// increasing precedence, its tagged meta fields, Metable, ComputedMetable and
+// metaFn, so that a key from a later source replaces an earlier one while the
+// others accumulate; a nil result adds nothing.
+func MarshalPayloadWithResourceMeta(w io.Writer, models interface{},
+	metaFn func(model interface{}) *Meta, opts ...Option) error {
+	return MarshalPayload(w, models, appendOption(opts, withResourceMeta(metaFn))...)
+}
+
+// mergeMeta merges meta over the top-level meta of payload.
+func mergeMeta(payload Payloader, meta Meta) {
+	var current **Meta
+	switch p := payload.(type) {
+	case *OnePayload:
+		current = &p.Meta
+	case *ManyPayload:
+		current = &p.Meta
+	}
+
+	// The Metable meta is copied rather than modified as its map may be
+	// shared by the caller
+	merged := Meta{}
+	if *current != nil {
+		for k, v := range **current {
+			merged[k] = v
+		}
+	}
+	for k, v := range meta {
+		merged[k] = v
+	}
+	*current = &merged
+}
+
+// MarshalPayloadContext writes a jsonapi response like MarshalPayload, passing
+// ctx to the models implementing FieldVisibilityByContext so that the fields
+// emitted may depend on e.g. the authenticated user of the request.
+func MarshalPayloadContext(ctx context.Context, w io.Writer, models interface{}, opts ...Option) error {
+	return MarshalPayload(w, models, appendOption(opts, withContext(ctx))...)
+}
+
+// MarshalPayloadWithFieldsets writes a jsonapi response like MarshalPayload,
+// limiting the attributes and relationships of each resource type to the
+// sparse fieldset given for it, e.g. the names from a "?fields[blogs]=title"
+// query keyed by "blogs". It applies to included resources too; types missing
+// from fields are emitted in full. A relationship left out of a fieldset is
+// not sideloaded either.
+func MarshalPayloadWithFieldsets(w io.Writer, models interface{},
+	fields map[string][]string, opts ...Option) error {
+	return MarshalPayload(w, models, appendOption(opts, withFieldsets(fields))...)
+}
+
+// MarshalPayloadWithExtraRelationships writes a jsonapi response for model,
+// a struct pointer, like MarshalPayload, merging relationships into the ones
+// built from its fields, e.g. derived ones assembled outside the struct. The
+// values must be *RelationshipOneNode or *RelationshipManyNode whose linkage
+// has a type and id; a clashing name replaces the field's relationship. Their
+// resources aren't added to "included".
+func MarshalPayloadWithExtraRelationships(w io.Writer, model interface{},
+	relationships map[string]interface{}, opts ...Option) error {
+	if reflect.ValueOf(model).Kind() != reflect.Ptr {
+		return ErrUnexpectedType
+	}
+
+	for name, relationship := range relationships {
+		if err := validateRelationship(relationship); err != nil {
+			return fmt.Errorf("%w: %s", err, name)
+		}
+	}
+
+	return MarshalPayload(w, model, appendOption(opts, withExtraRelationships(relationships))...)
+}
+
+// MarshalPayloadWithTypeAliases writes a jsonapi response like MarshalPayload,
+// renaming the emitted type of resources per aliases, e.g.
+// map[string]string{"posts": "articles"}, so that the same models can be
+// presented under different type names. The renames apply to the primary
+// data, relationship linkage and included resources alike.
+func MarshalPayloadWithTypeAliases(w io.Writer, models interface{},
+	aliases map[string]string, opts ...Option) error {
+	return MarshalPayload(w, models, appendOption(opts, withTypeAliases(aliases))...)
+}
+
+// MarshalPayloadFlat writes model, a struct pointer, in a NON-STANDARD shape
+// where the attributes are promoted into the data object rather than nested
+// under "attributes", e.g. {"data": {"type": "posts", "id": "1", "title": ...}},
+// for legacy clients that can't read JSON API documents. The other resource
+// members are kept as is and win over an attribute of the same name; nothing
+// is sideloaded into "included".
+func MarshalPayloadFlat(w io.Writer, model interface{}, opts ...Option) error {
+	if reflect.ValueOf(model).Kind() != reflect.Ptr {
+		return ErrUnexpectedType
+	}
+
+	payload, err := Marshal(model, opts...)
+	if err != nil {
+		return err
+	}
+	node := *payload.(*OnePayload).Data
+
+	flat := make(map[string]interface{}, len(node.Attributes))
+	for k, v := range node.Attributes {
+		flat[k] = v
+	}
+
+	node.Attributes = nil
+	buf, err := json.Marshal(&node)
+	if err != nil {
+		return err
+	}
+	var members map[string]interface{}
+	if err := json.Unmarshal(buf, &members); err != nil {
+		return err
+	}
+	for k, v := range members {
+		flat[k] = v
+	}
+
+	return json.NewEncoder(w).Encode(map[string]interface{}{"data": flat})
+}
+
+// MarshalPayloadWithVersion writes a jsonapi response like MarshalPayload,
+// adding the top-level jsonapi object with the given version, e.g.
+// {"jsonapi": {"version": "1.1"}}, to declare the implementation's support.
+func MarshalPayloadWithVersion(w io.Writer, models interface{}, version string,
+	opts ...Option) error {
+	return MarshalPayload(w, models, appendOption(opts, withVersion(version))...)
+}
+
+// MarshalSize returns the number of bytes MarshalPayload would write for
+// models, e.g. for a Content-Length header or to enforce a quota, without
+// keeping the output.
+func MarshalSize(models interface{}, opts ...Option) (int64, error) {
+	w := &countingWriter{w: ioutil.Discard}
+	if err := MarshalPayload(w, models, opts...); err != nil {
+		return 0, err
+	}
+	return w.n, nil
+}
+
+// countingWriter counts the bytes written through it to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // Marshal does the same as MarshalPayload except it just returns the payload
 // and doesn't write out results. Useful if you use your own JSON rendering
 // library.
-func Marshal(models interface{}) (Payloader, error) {
+func Marshal(models interface{}, opts ...Option) (Payloader, error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	var payload Payloader
 	switch vals := reflect.ValueOf(models); vals.Kind() {
 	case reflect.Slice:
 		m, err := convertToSliceInterface(&models)
@@ -103,7 +353,7 @@ func Marshal(models interface{}) (Payloader, error) {
 			return nil, err
 		}
 
-		payload, err := marshalMany(m)
+		many, err := marshalMany(m, o)
 		if err != nil {
 			return nil, err
 		}
@@ -113,23 +363,109 @@ func Marshal(models interface{}) (Payloader, error) {
 			if er := jl.validate(); er != nil {
 				return nil, er
 			}
-			payload.Links = linkableModels.JSONAPILinks()
+			many.Links = linkableModels.JSONAPILinks()
 		}
 
 		if metableModels, ok := models.(Metable); ok {
-			payload.Meta = metableModels.JSONAPIMeta()
+			many.Meta = metableModels.JSONAPIMeta()
 		}
 
-		return payload, nil
+		payload = many
 	case reflect.Ptr:
+		// Generic callers may hand us extra levels of indirection (**Blog);
+		// walk down to the pointer that actually references the struct
+		for vals.Elem().Kind() == reflect.Ptr {
+			vals = vals.Elem()
+		}
+
 		// Check that the pointer was to a struct
 		if reflect.Indirect(vals).Kind() != reflect.Struct {
 			return nil, ErrUnexpectedType
 		}
-		return marshalOne(models)
+
+		one, err := marshalOne(vals.Interface(), o)
+		if err != nil {
+			return nil, err
+		}
+
+		if metableModel, ok := vals.Interface().(TopLevelMetable); ok {
+			one.Meta = metableModel.JSONAPITopLevelMeta()
+		}
+
+		if len(o.extraRelationships) > 0 {
+			if one.Data.Relationships == nil {
+				one.Data.Relationships = make(map[string]interface{})
+			}
+			// finishPayload rewrites nodes in place, so the caller's are copied
+			for name, relationship := range o.extraRelationships {
+				one.Data.Relationships[name] = copyRelationship(relationship)
+			}
+		}
+
+		payload = one
 	default:
 		return nil, ErrUnexpectedType
 	}
+
+	finishPayload(payload, o)
+
+	if o.version != "" {
+		obj := &JSONAPIObject{Version: o.version}
+		switch p := payload.(type) {
+		case *OnePayload:
+			p.JSONAPI = obj
+		case *ManyPayload:
+			p.JSONAPI = obj
+		}
+	}
+
+	return payload, nil
+}
+
+// validateRelationship checks that relationship is a relationship node whose
+// linkage all has a type and id.
+func validateRelationship(relationship interface{}) error {
+	var linkage []*Node
+	switch r := relationship.(type) {
+	case *RelationshipOneNode:
+		// null linkage is valid for a to-one relationship
+		if r != nil && r.Data != nil {
+			linkage = append(linkage, r.Data)
+		}
+	case *RelationshipManyNode:
+		if r == nil {
+			return ErrInvalidRelationship
+		}
+		linkage = r.Data
+	default:
+		return ErrInvalidRelationship
+	}
+
+	for _, n := range linkage {
+		if n == nil || n.Type == "" || n.ID == "" {
+			return ErrInvalidRelationship
+		}
+	}
+	return nil
+}
+
+// finishPayload applies the options that rewrite a built payload as a whole.
+func finishPayload(payload Payloader, o *options) {
+	if o.baseURL != "" {
+		applyBaseURL(payload, o.baseURL)
+	}
+
+	if len(o.typeAliases) > 0 {
+		applyTypeAliases(payload, o.typeAliases)
+	}
+
+	if o.canonical {
+		sortIncluded(payload)
+	}
+
+	if o.sortedLinkage {
+		sortLinkage(payload)
+	}
 }
 
 // MarshalPayloadWithoutIncluded writes a jsonapi response with one or many
@@ -139,8 +475,8 @@ func Marshal(models interface{}) (Payloader, error) {
 //
 // models interface{} should be either a struct pointer or a slice of struct
 // pointers.
-func MarshalPayloadWithoutIncluded(w io.Writer, model interface{}) error {
-	payload, err := Marshal(model)
+func MarshalPayloadWithoutIncluded(w io.Writer, model interface{}, opts ...Option) error {
+	payload, err := Marshal(model, opts...)
 	if err != nil {
 		return err
 	}
@@ -152,12 +488,15 @@ func MarshalPayloadWithoutIncluded(w io.Writer, model interface{}) error {
 // marshalOne does the same as MarshalOnePayload except it just returns the
 // payload and doesn't write out results. Useful is you use your JSON rendering
 // library.
-func marshalOne(model interface{}) (*OnePayload, error) {
+func marshalOne(model interface{}, o *options) (*OnePayload, error) {
 	included := make(map[string]*Node)
-	rootNode, err := visitModelNode(model, &included, true)
+	rootNode, err := visitModelNode(model, &included, true, 0, o)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkIncludedCount(included, o); err != nil {
+		return nil, err
+	}
 	payload := &OnePayload{Data: rootNode}
 	payload.Included = nodeMapValues(&included)
 
@@ -167,19 +506,27 @@ func marshalOne(model interface{}) (*OnePayload, error) {
 // marshalMany does the same as MarshalManyPayload except it just returns the
 // payload and doesn't write out results. Useful is you use your JSON rendering
 // library.
-func marshalMany(models []interface{}) (*ManyPayload, error) {
+func marshalMany(models []interface{}, o *options) (*ManyPayload, error) {
 	payload := &ManyPayload{
 		Data: []*Node{},
 	}
 	included := map[string]*Node{}
 
-	for _, model := range models {
-		node, err := visitModelNode(model, &included, true)
+	for i, model := range models {
+		node, err := visitModelNode(model, &included, true, 0, o)
 		if err != nil {
-			return nil, err
+			return nil, &MarshalError{
+				Index: i,
+				Type:  primaryType(reflect.TypeOf(model)),
+				ID:    primaryID(model, o),
+				Err:   err,
+			}
 		}
 		payload.Data = append(payload.Data, node)
 	}
+	if err := checkIncludedCount(included, o); err != nil {
+		return nil, err
+	}
 	payload.Included = nodeMapValues(&included)
 
 	return payload, nil
@@ -200,42 +547,60 @@ func marshalMany(models []interface{}) (*ManyPayload, error) {
 // this method is intended for.
 //
 // model interface{} should be a pointer to a struct.
-func MarshalOnePayloadEmbedded(w io.Writer, model interface{}) error {
-	rootNode, err := visitModelNode(model, nil, false)
+func MarshalOnePayloadEmbedded(w io.Writer, model interface{}, opts ...Option) error {
+	o := newOptions(opts)
+	if o.err != nil {
+		return o.err
+	}
+
+	rootNode, err := visitModelNode(model, nil, false, 0, o)
 	if err != nil {
 		return err
 	}
 
 	payload := &OnePayload{Data: rootNode}
+	if o.baseURL != "" {
+		applyBaseURL(payload, o.baseURL)
+	}
 
 	return json.NewEncoder(w).Encode(payload)
 }
 
-func visitModelNode(model interface{}, included *map[string]*Node, sideload bool) (*Node, error) {
+func visitModelNode(model interface{}, included *map[string]*Node, sideload bool,
+	depth int, o *options) (*Node, error) {
 	node := new(Node)
 	v := reflect.ValueOf(model)
 	modelValue := reflect.ValueOf(model).Elem()
-	modelType := reflect.ValueOf(model).Type().Elem()
 
 	if v.IsNil() {
 		return nil, nil
 	}
 
-	for i := 0; i < modelValue.NumField(); i++ {
-		structField := modelValue.Type().Field(i)
-		tag := structField.Tag.Get(annotationJSONAPI)
-		if tag == "" {
-			continue
+	exposed := exposedFields(model, o)
+
+	// Past the maximum depth only the resource identifier is built
+	identifierOnly := !o.visitsDepth(depth)
+
+	// The key of the resource, once known, is tracked in o.visiting until
+	// the node is built; deferred once here rather than within the loop
+	var visiting resourceKey
+	defer func() {
+		if visiting.id != "" {
+			delete(o.visiting, visiting)
 		}
+	}()
 
+	for _, field := range modelFields(modelValue, o.promoteEmbedded, false) {
 		fb := fieldbuilder{
 			model:      model,
 			node:       node,
 			included:   included,
 			sideload:   sideload,
-			args:       strings.Split(tag, annotationSeperator),
-			fieldValue: modelValue.Field(i),
-			fieldType:  modelType.Field(i),
+			depth:      depth,
+			opts:       o,
+			args:       field.args,
+			fieldValue: field.value,
+			fieldType:  field.structField,
 		}
 
 		if len(fb.args) < 1 {
@@ -245,27 +610,55 @@ func visitModelNode(model interface{}, included *map[string]*Node, sideload bool
 		annotation := fb.args[0]
 
 		if (annotation == annotationClientID && len(fb.args) != 1) ||
-			(annotation != annotationClientID && len(fb.args) < 2) {
+			(annotation != annotationClientID && annotation != annotationMeta && len(fb.args) < 2) {
 			return nil, ErrBadJSONAPIStructTag
 		}
 
+		if identifierOnly && annotation != annotationPrimary {
+			continue
+		}
+
 		switch annotation {
 		case annotationPrimary:
 			if err := fb.doPrimary(); err != nil {
 				return fb.node, err
 			}
+
+			// A resource met again while its own relationships are being
+			// visited is only linked, cutting the cycle
+			if node.ID != "" {
+				key := resourceKey{node.Type, node.ID}
+				if o.visiting[key] {
+					return toShallowNode(node), nil
+				}
+				if o.visiting == nil {
+					o.visiting = make(map[resourceKey]bool)
+				}
+				o.visiting[key] = true
+				visiting = key
+			}
 		case annotationClientID:
 			clientID := fb.fieldValue.String()
 			if clientID != "" {
-				fb.node.ClientID = clientID
+				fb.opts.setClientID(fb.node, clientID)
 			}
 		case annotationExtends:
 			if err := fb.doExtends(); err != nil {
 				return nil, err
 			}
 		case annotationAttribute:
-			fb.doAttribute()
+			if err := fb.doAttribute(); err != nil {
+				return nil, err
+			}
+		case annotationMeta:
+			if err := fb.doMeta(); err != nil {
+				return nil, err
+			}
 		case annotationRelation:
+			// Skip hidden relations up front so they are never sideloaded
+			if exposed != nil && !exposed[fb.args[1]] {
+				continue
+			}
 			if err := fb.doRelation(); err != nil {
 				return nil, err
 			}
@@ -274,6 +667,44 @@ func visitModelNode(model interface{}, included *map[string]*Node, sideload bool
 		}
 	}
 
+	if identifierOnly {
+		return node, nil
+	}
+
+	if provider, ok := model.(RelationshipProvider); ok {
+		computed := provider.JSONAPIComputedRelationships(included, sideload)
+		if len(computed) > 0 && node.Relationships == nil {
+			node.Relationships = make(map[string]interface{})
+		}
+		for k, v := range computed {
+			node.Relationships[k] = v
+		}
+	}
+
+	if exposed != nil {
+		node.retain(exposed)
+	}
+
+	if hook := typeAttributeHook(node.Type); hook != nil {
+		if node.Attributes == nil {
+			node.Attributes = make(map[string]interface{})
+		}
+		hook(node.Attributes)
+	}
+
+	if o.attributeKeyPrefix != "" {
+		node.prefixAttributes(o.attributeKeyPrefix)
+	}
+
+	if linker, ok := model.(AttributeLinker); ok && o.attributeLinksKey != "" {
+		if links := linker.JSONAPIAttributeLinks(); len(links) > 0 {
+			if node.Attributes == nil {
+				node.Attributes = make(map[string]interface{})
+			}
+			node.Attributes[o.attributeLinksKey] = links
+		}
+	}
+
 	if linkableModel, isLinkable := model.(Linkable); isLinkable {
 		jl := linkableModel.JSONAPILinks()
 		if er := jl.validate(); er != nil {
@@ -282,14 +713,61 @@ func visitModelNode(model interface{}, included *map[string]*Node, sideload bool
 		node.Links = linkableModel.JSONAPILinks()
 	}
 
+	// The resource meta accumulates from, in increasing precedence, the tagged
+	// meta fields, Metable, ComputedMetable and the call-time meta function
+	var metas []*Meta
 	if metableModel, ok := model.(Metable); ok {
-		node.Meta = metableModel.JSONAPIMeta()
+		metas = append(metas, metableModel.JSONAPIMeta())
+	}
+	if computed, ok := model.(ComputedMetable); ok {
+		metas = append(metas, computed.JSONAPIComputedMeta(o.requestContext()))
+	}
+	if o.resourceMeta != nil {
+		metas = append(metas, o.resourceMeta(model))
+	}
+	for _, meta := range metas {
+		if meta == nil {
+			continue
+		}
+		if node.Meta == nil {
+			// The returned maps may be shared by the caller, so are copied
+			// rather than extended; node.Meta is ours once allocated
+			node.Meta = &Meta{}
+		}
+		for k, v := range *meta {
+			(*node.Meta)[k] = v
+		}
 	}
 
 	return node, nil
 }
 
 func (fb fieldbuilder) doPrimary() error {
+	if fb.node.Type == "" {
+		fb.node.Type = fb.args[1]
+	}
+
+	if composite, ok := fb.model.(IDComposite); ok {
+		id, err := composite.JSONAPIID()
+		if err != nil {
+			return err
+		}
+		fb.node.ID = id
+		return nil
+	}
+
+	if generator, ok := fb.model.(IDGenerator); ok && isEmptyValue(fb.fieldValue) {
+		fb.node.ID = generator.JSONAPIGenerateID()
+		return nil
+	}
+
+	var keepID bool
+	for _, arg := range fb.args[2:] {
+		if arg == annotationKeepID {
+			keepID = true
+		}
+	}
+
 	v := fb.fieldValue
 
 	// Deal with PTRS
@@ -297,10 +775,27 @@ func (fb fieldbuilder) doPrimary() error {
 	if fb.fieldValue.Kind() == reflect.Ptr {
 		kind = fb.fieldType.Type.Elem().Kind()
 		v = reflect.Indirect(fb.fieldValue)
+
+		// A nil id is left out unless the zero id is meaningful
+		if fb.fieldValue.IsNil() {
+			if !keepID {
+				return nil
+			}
+			v = reflect.Zero(fb.fieldType.Type.Elem())
+		}
 	} else {
 		kind = fb.fieldType.Type.Kind()
 	}
 
+	if marshaler := idMarshaler(v); marshaler != nil {
+		id, err := marshaler.JSONAPIID()
+		if err != nil {
+			return err
+		}
+		fb.node.ID = id
+		return nil
+	}
+
 	// Handle allowed types
 	switch kind {
 	case reflect.String:
@@ -326,19 +821,73 @@ func (fb fieldbuilder) doPrimary() error {
 	case reflect.Uint64:
 		fb.node.ID = strconv.FormatUint(v.Interface().(uint64), 10)
 	default:
+		// Opaque ids, e.g. an encrypted token, stringify themselves
+		if stringer, ok := v.Interface().(fmt.Stringer); ok {
+			fb.node.ID = stringer.String()
+			return nil
+		}
+
 		// We had a JSON float (numeric), but our field was not one of the
 		// allowed numeric types
 		return ErrBadJSONAPIID
 	}
 
-	if fb.node.Type == "" {
-		fb.node.Type = fb.args[1]
+	return nil
+}
+
+func (fb fieldbuilder) doMeta() error {
+	// A bare "meta" tag holds the whole meta object, e.g. a typed struct
+	if len(fb.args) == 1 {
+		return fb.doMetaObject()
+	}
+
+	for _, arg := range fb.args[2:] {
+		if arg == annotationOmitEmpty && isEmptyValue(fb.fieldValue) {
+			return nil
+		}
+	}
+
+	if fb.node.Meta == nil {
+		fb.node.Meta = &Meta{}
+	}
+
+	(*fb.node.Meta)[fb.args[1]] = fb.fieldValue.Interface()
+	return nil
+}
+
+func (fb fieldbuilder) doMetaObject() error {
+	if fb.fieldValue.Kind() == reflect.Ptr && fb.fieldValue.IsNil() {
+		return nil
+	}
+
+	// Round trip through encoding/json so the field's json tags apply
+	raw, err := json.Marshal(fb.fieldValue.Interface())
+	if err != nil {
+		return err
+	}
+
+	meta := Meta{}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return ErrInvalidType
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+
+	if fb.node.Meta == nil {
+		fb.node.Meta = &Meta{}
+	}
+	for k, v := range meta {
+		(*fb.node.Meta)[k] = v
 	}
+
 	return nil
 }
 
-func (fb fieldbuilder) doAttribute() {
-	var omitEmpty, iso8601 bool
+func (fb fieldbuilder) doAttribute() error {
+	var omitEmpty, iso8601, dateOnly, keepZero bool
+	path := []string{fb.args[1]}
+	layout := timeLayout(fb.args[2:])
 
 	if len(fb.args) > 2 {
 		for _, arg := range fb.args[2:] {
@@ -347,62 +896,135 @@ func (fb fieldbuilder) doAttribute() {
 				omitEmpty = true
 			case annotationISO8601:
 				iso8601 = true
+			case annotationDateOnly:
+				dateOnly = true
+			case annotationKeepZero:
+				keepZero = true
+			case annotationNested:
+				path = strings.Split(fb.args[1], annotationPathSeparator)
 			}
 		}
 	}
 
+	// An untouched attribute is left out entirely, while a touched one is
+	// always emitted, as null for a nil pointer
+	if tagArg(fb.args, annotationTouched) != "" {
+		touched, err := fb.touched()
+		if err != nil || !touched {
+			return err
+		}
+		omitEmpty = false
+	}
+
 	if fb.node.Attributes == nil {
 		fb.node.Attributes = make(map[string]interface{})
 	}
 
-	if fb.fieldValue.Type() == reflect.TypeOf(time.Time{}) {
-		t := fb.fieldValue.Interface().(time.Time)
+	isNilPtr := fb.fieldValue.Kind() == reflect.Ptr && fb.fieldValue.IsNil()
 
-		if t.IsZero() {
-			return
+	if encode, value := attributeEncoder(fb.fieldValue); encode != nil {
+		if omitEmpty && isEmptyValue(fb.fieldValue) {
+			return nil
 		}
 
-		if iso8601 {
-			fb.node.Attributes[fb.args[1]] = t.UTC().Format(iso8601TimeFormat)
-		} else {
-			fb.node.Attributes[fb.args[1]] = t.Unix()
+		v, err := encode(value)
+		if err != nil {
+			return err
+		}
+		fb.node.setAttribute(path, v)
+	} else if marshaler := attrMarshaler(fb.fieldValue); marshaler != nil && !isNilPtr {
+		if omitEmpty && isEmptyValue(fb.fieldValue) {
+			return nil
+		}
+
+		v, err := marshaler.MarshalJSONAPIAttribute()
+		if err != nil {
+			return err
 		}
-	} else if fb.fieldValue.Type() == reflect.TypeOf(new(time.Time)) {
+		fb.node.setAttribute(path, v)
+	} else if enum, ok := fb.fieldValue.Interface().(JSONAPIEnum); ok && !isNilPtr {
+		if omitEmpty && isEmptyValue(fb.fieldValue) {
+			return nil
+		}
+
+		fb.node.setAttribute(path, enum.JSONAPIEnumValue())
+	} else if isTime(fb.fieldValue.Type()) {
+		t := fb.fieldValue.Convert(timeType).Interface().(time.Time)
+
+		if t.IsZero() {
+			// Zero times are omitted unless asked to be sent as null
+			if keepZero {
+				fb.node.setAttribute(path, nil)
+			}
+			return nil
+		}
+
+		fb.node.setAttribute(path, formatTime(t, layout, iso8601, dateOnly))
+	} else if isTimePtr(fb.fieldValue.Type()) {
 		// A time pointer may be nil
 		if fb.fieldValue.IsNil() {
 			if omitEmpty {
-				return
+				return nil
 			}
 
-			fb.node.Attributes[fb.args[1]] = nil
+			fb.node.setAttribute(path, nil)
 		} else {
-			tm := fb.fieldValue.Interface().(*time.Time)
+			tm := fb.fieldValue.Elem().Convert(timeType).Interface().(time.Time)
 
 			if tm.IsZero() && omitEmpty {
-				return
+				return nil
 			}
 
-			if iso8601 {
-				fb.node.Attributes[fb.args[1]] = tm.UTC().Format(iso8601TimeFormat)
-			} else {
-				fb.node.Attributes[fb.args[1]] = tm.Unix()
-			}
+			fb.node.setAttribute(path, formatTime(tm, layout, iso8601, dateOnly))
+		}
+	} else if isTimeSlice(fb.fieldValue.Type()) {
+		if omitEmpty && fb.fieldValue.Len() == 0 {
+			return nil
 		}
-	} else {
-		emptyValue := reflect.Zero(fb.fieldValue.Type())
 
-		// See if we need to omit this field
-		if omitEmpty && fb.fieldValue.Interface() == emptyValue.Interface() {
-			return
+		if fb.fieldValue.IsNil() {
+			fb.node.setAttribute(path, nil)
+			return nil
 		}
 
-		strAttr, ok := fb.fieldValue.Interface().(string)
+		times := make([]interface{}, fb.fieldValue.Len())
+		for i := range times {
+			elem := fb.fieldValue.Index(i)
+			if elem.Kind() == reflect.Ptr {
+				if elem.IsNil() {
+					continue
+				}
+				elem = elem.Elem()
+			}
+			times[i] = formatTime(elem.Convert(timeType).Interface().(time.Time), layout, iso8601, dateOnly)
+		}
+
+		fb.node.setAttribute(path, times)
+	} else {
+		sentinel, err := nullIfSentinel(fb.args, fb.fieldValue.Type())
+		if err != nil {
+			return err
+		}
+		if sentinel.IsValid() && fb.fieldValue.Interface() == sentinel.Interface() {
+			fb.node.setAttribute(path, nil)
+			return nil
+		}
+
+		// See if we need to omit this field; IsZero is used rather than ==
+		// so that structs holding slices or maps don't panic
+		if omitEmpty && isEmptyValue(fb.fieldValue) {
+			return nil
+		}
+
+		strAttr, ok := fb.fieldValue.Interface().(string)
 		if ok {
-			fb.node.Attributes[fb.args[1]] = strAttr
+			fb.node.setAttribute(path, strAttr)
 		} else {
-			fb.node.Attributes[fb.args[1]] = fb.fieldValue.Interface()
+			fb.node.setAttribute(path, fb.fieldValue.Interface())
 		}
 	}
+
+	return nil
 }
 
 func (fb fieldbuilder) doExtends() error {
@@ -410,7 +1032,7 @@ func (fb fieldbuilder) doExtends() error {
 		fb.node.Attributes = make(map[string]interface{})
 	}
 
-	n, err := visitModelNode(fb.fieldValue.Interface(), fb.included, fb.sideload)
+	n, err := visitModelNode(fb.fieldValue.Interface(), fb.included, fb.sideload, fb.depth, fb.opts)
 	if err != nil {
 		return err
 	}
@@ -432,24 +1054,81 @@ func (fb fieldbuilder) doExtends() error {
 }
 
 func (fb fieldbuilder) doRelation() error {
-	var omitEmpty bool
+	omitEmpty := fb.opts.omitEmptyRelationships
 
-	//add support for 'omitempty' struct tag for marshaling as absent
+	//add support for 'omitempty' struct tag for marshaling as absent,
+	//'keep' to always emit the relationship whatever the options, and
+	//'linkonly' to emit its links without linkage
+	var linkOnly bool
 	if len(fb.args) > 2 {
-		omitEmpty = fb.args[2] == annotationOmitEmpty
+		var keep bool
+		for _, arg := range fb.args[2:] {
+			switch arg {
+			case annotationOmitEmpty:
+				omitEmpty = true
+			case annotationKeep:
+				keep = true
+			case annotationLinkOnly:
+				linkOnly = true
+			}
+		}
+		omitEmpty = omitEmpty && !keep
+	}
+
+	// A relationship keyed by id is marshaled as a to-many relationship of its
+	// values, in key order
+	if mapRelation(fb.args) {
+		values, err := mapRelationValues(fb.fieldValue)
+		if err != nil {
+			return err
+		}
+		fb.fieldValue = values
+	}
+
+	// An untouched relationship is left out entirely, while a touched nil one
+	// is emitted as null
+	touched, err := fb.touched()
+	if err != nil || !touched {
+		return err
 	}
 
 	isSlice := fb.fieldValue.Type().Kind() == reflect.Slice
-	if omitEmpty &&
-		(isSlice && fb.fieldValue.Len() < 1 ||
-			(!isSlice && fb.fieldValue.IsNil())) {
-		return nil
+	sideload := fb.sideload && fb.opts.sideloads(fb.args[1])
+
+	// The linkage of an ids only relationship is built from its ids field
+	// whatever its models
+	idsOnly, err := idsOnlyRelation(fb.args)
+	if err != nil {
+		return err
+	}
+	if idsOnly && isSlice {
+		fb.fieldValue = reflect.MakeSlice(fb.fieldValue.Type(), 0, 0)
+	}
+	// Past the maximum include depth related resources are only linked
+	include := sideload && fb.opts.includesDepth(fb.depth+1) &&
+		fb.opts.visitsDepth(fb.depth+1)
+
+	// Without related models to visit, linkage may still be built from the
+	// sibling ids field
+	var ids []string
+	if isSlice && fb.fieldValue.Len() < 1 || idsOnly {
+		var err error
+		if ids, err = fb.relationIDs(); err != nil {
+			return err
+		}
+	}
+	if !isSlice && len(ids) > 1 {
+		return fmt.Errorf("%w: %s holds %d ids for a to-one relationship",
+			ErrInvalidRelationship, fb.args[1], len(ids))
 	}
 
-	if fb.node.Relationships == nil {
-		fb.node.Relationships = make(map[string]interface{})
+	if filter, ok := fb.model.(RelationshipElementFilter); ok && isSlice {
+		fb.fieldValue = filterRelation(filter, fb.args[1], fb.fieldValue)
 	}
 
+	// A to-one relation may be a struct value rather than a pointer
+	isValue := fb.fieldValue.Kind() == reflect.Struct
+
 	var relLinks *Links
 	if linkableModel, ok := fb.model.(RelationshipLinkable); ok {
 		relLinks = linkableModel.JSONAPIRelationshipLinks(fb.args[1])
@@ -460,12 +1139,66 @@ func (fb fieldbuilder) doRelation() error {
 		relMeta = metableModel.JSONAPIRelationshipMeta(fb.args[1])
 	}
 
-	if isSlice {
+	if paginator, ok := fb.opts.paginators[fb.args[1]]; ok && isSlice {
+		relLinks, relMeta = paginate(paginator, fb.model, relLinks, relMeta)
+	}
+
+	// A link only relationship is emitted whatever its models, which are
+	// usually not loaded at all
+	if linkOnly && relLinks != nil {
+		if fb.node.Relationships == nil {
+			fb.node.Relationships = make(map[string]interface{})
+		}
+		fb.node.Relationships[fb.args[1]] = &RelationshipLinksNode{
+			Links: relLinks,
+			Meta:  relMeta,
+		}
+		return nil
+	}
+
+	if omitEmpty && len(ids) == 0 &&
+		(idsOnly || isSlice && fb.fieldValue.Len() < 1 ||
+			(isValue && fb.fieldValue.IsZero()) ||
+			(!isSlice && !isValue && fb.fieldValue.IsNil())) {
+		return nil
+	}
+
+	if fb.node.Relationships == nil {
+		fb.node.Relationships = make(map[string]interface{})
+	}
+
+	if idsOnly && !isSlice {
+		// to-one relationship linked from its single id, if any
+		var linkage *Node
+		if len(ids) > 0 {
+			linkage = &Node{Type: primaryType(fb.fieldValue.Type()), ID: ids[0]}
+		}
+
+		fb.node.Relationships[fb.args[1]] = &RelationshipOneNode{
+			Data:  linkage,
+			Links: relLinks,
+			Meta:  relMeta,
+		}
+	} else if len(ids) > 0 {
+		nodeType := primaryType(fb.fieldValue.Type().Elem())
+		linkage := make([]*Node, len(ids))
+		for i, id := range ids {
+			linkage[i] = &Node{Type: nodeType, ID: id}
+		}
+
+		fb.node.Relationships[fb.args[1]] = &RelationshipManyNode{
+			Data:  linkage,
+			Links: relLinks,
+			Meta:  relMeta,
+		}
+	} else if isSlice {
 		// to-many relationship
 		relationship, err := visitModelNodeRelationships(
 			fb.fieldValue,
 			fb.included,
 			fb.sideload,
+			fb.depth+1,
+			fb.opts,
 		)
 		if err != nil {
 			return err
@@ -473,11 +1206,20 @@ func (fb fieldbuilder) doRelation() error {
 		relationship.Links = relLinks
 		relationship.Meta = relMeta
 
-		if fb.sideload {
+		if sideload {
 			shallowNodes := []*Node{}
-			for _, n := range relationship.Data {
-				appendIncluded(fb.included, n)
-				shallowNodes = append(shallowNodes, toShallowNode(n))
+			for i := 0; i < fb.fieldValue.Len(); i++ {
+				related := fb.fieldValue.Index(i)
+				if isNilModel(related) {
+					continue
+				}
+				n := relationship.Data[len(shallowNodes)]
+				if include && !fb.opts.visitingNode(n) {
+					appendIncluded(fb.included, n)
+				}
+				shallow := toShallowNode(n)
+				shallow.Meta = linkageMeta(related.Interface())
+				shallowNodes = append(shallowNodes, shallow)
 			}
 
 			fb.node.Relationships[fb.args[1]] = &RelationshipManyNode{
@@ -490,26 +1232,36 @@ func (fb fieldbuilder) doRelation() error {
 		}
 	} else {
 		// to-one relationships
+		related := fb.fieldValue
+		if isValue {
+			related = related.Addr()
+		}
 
 		// Handle null relationship case
-		if fb.fieldValue.IsNil() {
+		if related.IsNil() {
 			fb.node.Relationships[fb.args[1]] = &RelationshipOneNode{Data: nil}
 			return nil
 		}
 
 		relationship, err := visitModelNode(
-			fb.fieldValue.Interface(),
+			related.Interface(),
 			fb.included,
 			fb.sideload,
+			fb.depth+1,
+			fb.opts,
 		)
 		if err != nil {
 			return err
 		}
 
-		if fb.sideload {
-			appendIncluded(fb.included, relationship)
+		if sideload {
+			if include && !fb.opts.visitingNode(relationship) {
+				appendIncluded(fb.included, relationship)
+			}
+			shallow := toShallowNode(relationship)
+			shallow.Meta = linkageMeta(related.Interface())
 			fb.node.Relationships[fb.args[1]] = &RelationshipOneNode{
-				Data:  toShallowNode(relationship),
+				Data:  shallow,
 				Links: relLinks,
 				Meta:  relMeta,
 			}
@@ -524,6 +1276,767 @@ func (fb fieldbuilder) doRelation() error {
 	return nil
 }
 
+// paginate merges the pagination details from p over copies of the
+// relationship's links and meta.
+func paginate(p Paginator, model interface{}, links *Links, meta *Meta) (*Links, *Meta) {
+	count, page, pageLinks := p.Paginate(model)
+
+	merged := Meta{}
+	if meta != nil {
+		for k, v := range *meta {
+			merged[k] = v
+		}
+	}
+	merged["count"] = count
+	merged["page"] = page
+
+	if pageLinks != nil {
+		mergedLinks := Links{}
+		if links != nil {
+			for k, v := range *links {
+				mergedLinks[k] = v
+			}
+		}
+		for k, v := range *pageLinks {
+			mergedLinks[k] = v
+		}
+		links = &mergedLinks
+	}
+
+	return links, &merged
+}
+
+// idMarshaler returns the primary id v, or its address, as an IDMarshaler, or
+// nil when neither implements it.
+func idMarshaler(v reflect.Value) IDMarshaler {
+	if marshaler, ok := v.Interface().(IDMarshaler); ok {
+		return marshaler
+	}
+	if v.CanAddr() {
+		if marshaler, ok := v.Addr().Interface().(IDMarshaler); ok {
+			return marshaler
+		}
+	}
+	return nil
+}
+
+// zeroer is implemented by types with their own notion of zero, e.g. nullable
+// or decimal types.
+type zeroer interface {
+	IsZero() bool
+}
+
+// isEmptyValue reports whether an omitempty field should be omitted, deferring
+// to the value's own IsZero method when it has one.
+func isEmptyValue(v reflect.Value) bool {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return true
+	}
+
+	if z, ok := v.Interface().(zeroer); ok {
+		return z.IsZero()
+	}
+	if v.CanAddr() {
+		if z, ok := v.Addr().Interface().(zeroer); ok {
+			return z.IsZero()
+		}
+	}
+
+	return v.IsZero()
+}
+
+// formatTime renders a time attribute per the field's time format, a unix
+// timestamp unless one of the format tag arguments is set.
+func formatTime(t time.Time, layout string, iso8601, dateOnly bool) interface{} {
+	switch {
+	case layout != "":
+		return t.Format(layout)
+	case dateOnly:
+		return t.Format(dateOnlyFormat)
+	case iso8601:
+		return t.UTC().Format(iso8601TimeFormat)
+	default:
+		return t.Unix()
+	}
+}
+
+// attrMarshaler returns the field, or its address for pointer receivers, as
+// an AttrMarshaler, or nil when neither implements it.
+func attrMarshaler(field reflect.Value) AttrMarshaler {
+	if marshaler, ok := field.Interface().(AttrMarshaler); ok {
+		return marshaler
+	}
+
+	if field.CanAddr() {
+		if marshaler, ok := field.Addr().Interface().(AttrMarshaler); ok {
+			return marshaler
+		}
+	}
+
+	return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isTime reports whether t is time.Time or a type defined from it, e.g.
+// `type Timestamp time.Time`.
+func isTime(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t.ConvertibleTo(timeType)
+}
+
+// isTimePtr reports whether t is a pointer to a type accepted by isTime.
+func isTimePtr(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && isTime(t.Elem())
+}
+
+// isTimeSlice reports whether t is a slice of times or time pointers, as
+// accepted by isTime and isTimePtr.
+func isTimeSlice(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+
+	elem := t.Elem()
+	return isTime(elem) || isTimePtr(elem)
+}
+
+// namedTimeLayouts are the time layouts that may be named by a bare attribute
+// tag argument, e.g. "attr,published,rfc1123".
+var namedTimeLayouts = map[string]string{
+	"rfc822":      time.RFC822,
+	"rfc822z":     time.RFC822Z,
+	"rfc1123":     time.RFC1123,
+	"rfc1123z":    time.RFC1123Z,
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+}
+
+// timeLayout returns the time layout set by the extra attribute tag arguments,
+// or an empty string if there is none. A "layout=" argument takes the rest of
+// the tag, as layouts such as RFC1123 contain commas.
+func timeLayout(args []string) string {
+	for i, arg := range args {
+		for _, prefix := range []string{annotationLayout, annotationFormat} {
+			if strings.HasPrefix(arg, prefix) {
+				return strings.TrimPrefix(strings.Join(args[i:], annotationSeperator), prefix)
+			}
+		}
+		if layout, ok := namedTimeLayouts[arg]; ok {
+			return layout
+		}
+	}
+
+	return ""
+}
+
+// nullIfSentinel returns the value of a "nullif=" attribute tag argument
+// converted to the numeric type t, or an invalid Value when there is none.
+func nullIfSentinel(args []string, t reflect.Type) (reflect.Value, error) {
+	arg := tagArg(args, annotationNullIf)
+	if arg == "" {
+		return reflect.Value{}, nil
+	}
+
+	sentinel := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(arg, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, ErrBadJSONAPIStructTag
+		}
+		sentinel.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(arg, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, ErrBadJSONAPIStructTag
+		}
+		sentinel.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(arg, t.Bits())
+		if err != nil {
+			return reflect.Value{}, ErrBadJSONAPIStructTag
+		}
+		sentinel.SetFloat(n)
+	default:
+		return reflect.Value{}, ErrBadJSONAPIStructTag
+	}
+
+	return sentinel, nil
+}
+
+// relationIDs reads the sibling field named by an "ids:" relation tag
+// argument, if any.
+func (fb fieldbuilder) relationIDs() ([]string, error) {
+	name := relationIDsFieldName(fb.args)
+	if name == "" {
+		return nil, nil
+	}
+
+	field := reflect.ValueOf(fb.model).Elem().FieldByName(name)
+	if !field.IsValid() || field.Type() != reflect.TypeOf([]string{}) {
+		return nil, ErrBadJSONAPIStructTag
+	}
+
+	return field.Interface().([]string), nil
+}
+
+// touched reads the sibling bool field named by the "touched:" tag argument;
+// a relationship or attribute without one is always touched.
+func (fb fieldbuilder) touched() (bool, error) {
+	name := tagArg(fb.args, annotationTouched)
+	if name == "" {
+		return true, nil
+	}
+
+	field := reflect.ValueOf(fb.model).Elem().FieldByName(name)
+	if !field.IsValid() || field.Kind() != reflect.Bool {
+		return false, ErrBadJSONAPIStructTag
+	}
+
+	return field.Bool(), nil
+}
+
+// relationIDsFieldName returns the field name given by an "ids:" relation tag
+// argument, or "" when there is none.
+func relationIDsFieldName(args []string) string {
+	return tagArg(args, annotationRelationIDs)
+}
+
+// tagArg returns the value of the relation or attr tag argument with the given
+// prefix, or "" when there is none.
+func tagArg(args []string, prefix string) string {
+	if len(args) < 3 {
+		return ""
+	}
+
+	for _, arg := range args[2:] {
+		if strings.HasPrefix(arg, prefix) {
+			return strings.TrimPrefix(arg, prefix)
+		}
+	}
+	return ""
+}
+
+// mapRelation reports whether the relation tag has the "map" argument, its
+// field being a map of the related models keyed by their id.
+func mapRelation(args []string) bool {
+	return hasRelationFlag(args, annotationMap)
+}
+
+// idsOnlyRelation reports whether the relation tag has the "idsonly" argument,
+// the relationship being read from and written to its "ids:" field alone.
+// ErrBadJSONAPIStructTag is returned when there is no "ids:" field.
+func idsOnlyRelation(args []string) (bool, error) {
+	if !hasRelationFlag(args, annotationIDsOnly) {
+		return false, nil
+	}
+	if relationIDsFieldName(args) == "" {
+		return false, ErrBadJSONAPIStructTag
+	}
+	return true, nil
+}
+
+// hasRelationFlag reports whether the relation tag has the argument flag.
+func hasRelationFlag(args []string, flag string) bool {
+	if len(args) < 3 {
+		return false
+	}
+
+	for _, arg := range args[2:] {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMapRelation returns ErrBadJSONAPIStructTag unless t, the type of a
+// "map" relation field, is keyed by strings and holds struct pointers or
+// interfaces.
+func checkMapRelation(t reflect.Type) error {
+	if t.Kind() != reflect.Map || t.Key().Kind() != reflect.String {
+		return ErrBadJSONAPIStructTag
+	}
+
+	switch elem := t.Elem(); elem.Kind() {
+	case reflect.Interface:
+	case reflect.Ptr:
+		if elem.Elem().Kind() != reflect.Struct {
+			return ErrBadJSONAPIStructTag
+		}
+	default:
+		return ErrBadJSONAPIStructTag
+	}
+	return nil
+}
+
+// mapRelationValues returns the values of the map relation field v as a slice,
+// sorted by their keys so the linkage is deterministic.
+func mapRelationValues(v reflect.Value) (reflect.Value, error) {
+	if err := checkMapRelation(v.Type()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	values := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), 0, len(keys))
+	for _, k := range keys {
+		values = reflect.Append(values, v.MapIndex(k))
+	}
+	return values, nil
+}
+
+// filterRelation returns the related models of the to-many relation field v
+// that filter keeps, as a new slice.
+func filterRelation(filter RelationshipElementFilter, relation string,
+	v reflect.Value) reflect.Value {
+	kept := reflect.MakeSlice(v.Type(), 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if filter.JSONAPIIncludeRelationElement(relation, v.Index(i).Interface()) {
+			kept = reflect.Append(kept, v.Index(i))
+		}
+	}
+	return kept
+}
+
+// fieldDescriptor is a tagged field of a model type, possibly promoted from an
+// untagged embedded struct, with its tag parsed.
+type fieldDescriptor struct {
+	// index is the path of the field through embedded structs, see
+	// reflect.Value.FieldByIndex
+	index       []int
+	structField reflect.StructField
+	args        []string
+}
+
+type fieldsKey struct {
+	t       reflect.Type
+	promote bool
+}
+
+// fieldsCache holds the []fieldDescriptor of every model type seen, so that
+// tags are only parsed once per type.
+var fieldsCache sync.Map
+
+// typeFields returns the tagged fields of the struct type t in order,
+// followed, when promote is set, by the attr and relation fields promoted from
+// its untagged embedded structs, like encoding/json promotes the fields of
+// embedded structs. The outer field wins when names collide.
+func typeFields(t reflect.Type, promote bool) []fieldDescriptor {
+	key := fieldsKey{t: t, promote: promote}
+	if fields, ok := fieldsCache.Load(key); ok {
+		return fields.([]fieldDescriptor)
+	}
+
+	fields, _ := fieldsCache.LoadOrStore(key, buildTypeFields(t, promote))
+	return fields.([]fieldDescriptor)
+}
+
+func buildTypeFields(t reflect.Type, promote bool) []fieldDescriptor {
+	var fields, embedded []fieldDescriptor
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := fieldDescriptor{index: []int{i}, structField: t.Field(i)}
+
+		tag := field.structField.Tag.Get(annotationJSONAPI)
+		if tag == "" {
+			if promote && field.structField.Anonymous {
+				embedded = append(embedded, field)
+			}
+			continue
+		}
+
+		field.args = strings.Split(tag, annotationSeperator)
+		fields = append(fields, field)
+		if name, ok := promotedName(field.args); ok {
+			names[name] = true
+		}
+	}
+
+	for _, e := range embedded {
+		et := e.structField.Type
+		if et.Kind() == reflect.Ptr {
+			et = et.Elem()
+		}
+		if et.Kind() != reflect.Struct {
+			continue
+		}
+
+		for _, field := range buildTypeFields(et, promote) {
+			name, ok := promotedName(field.args)
+			if !ok || names[name] {
+				continue
+			}
+			names[name] = true
+			field.index = append(append([]int{}, e.index...), field.index...)
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// promotedName returns the attribute or relationship name of a field's tag
+// arguments, and whether the field may be promoted out of an embedded struct.
+func promotedName(args []string) (string, bool) {
+	if len(args) < 2 || (args[0] != annotationAttribute && args[0] != annotationRelation) {
+		return "", false
+	}
+	return args[1], true
+}
+
+// modelField is a tagged field of a model value.
+type modelField struct {
+	value reflect.Value
+	fieldDescriptor
+}
+
+// modelFields returns the fields of the struct v per typeFields. A field
+// promoted through a nil embedded struct pointer is skipped, unless alloc is
+// set in which case the pointer is allocated.
+func modelFields(v reflect.Value, promote, alloc bool) []modelField {
+	descriptors := typeFields(v.Type(), promote)
+	fields := make([]modelField, 0, len(descriptors))
+
+	for _, descriptor := range descriptors {
+		if fv, ok := fieldByIndex(v, descriptor.index, alloc); ok {
+			fields = append(fields, modelField{value: fv, fieldDescriptor: descriptor})
+		}
+	}
+	return fields
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, reporting false rather than
+// panicking on a nil embedded struct pointer unless alloc is set.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// primaryType returns the resource type declared by the primary tag of the
+// struct t (or the struct t points to).
+func primaryType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return ""
+	}
+
+	for _, field := range typeFields(t, false) {
+		if len(field.args) > 1 && field.args[0] == annotationPrimary {
+			return field.args[1]
+		}
+	}
+	return ""
+}
+
+// primaryID returns the id of model as its primary field is marshaled, or an
+// empty string when it can't be determined, e.g. for an error report.
+func primaryID(model interface{}, o *options) string {
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+
+	node := new(Node)
+	for _, field := range modelFields(v.Elem(), o.promoteEmbedded, false) {
+		if len(field.args) < 2 || field.args[0] != annotationPrimary {
+			continue
+		}
+
+		fb := fieldbuilder{
+			model:      model,
+			node:       node,
+			opts:       o,
+			args:       field.args,
+			fieldValue: field.value,
+			fieldType:  field.structField,
+		}
+		if err := fb.doPrimary(); err != nil {
+			return ""
+		}
+		return node.ID
+	}
+	return ""
+}
+
+// exposedFields returns the set of attribute and relationship names a
+// FieldsExposer model allows to be emitted, narrowed by the sparse fieldset of
+// its type, or nil if the model's fields aren't restricted.
+func exposedFields(model interface{}, o *options) map[string]bool {
+	exposed := modelExposedFields(model, o)
+
+	fieldset, ok := o.fieldsets[primaryType(reflect.TypeOf(model))]
+	if !ok {
+		return exposed
+	}
+
+	visible := make(map[string]bool)
+	for name := range fieldset {
+		if exposed == nil || exposed[name] {
+			visible[name] = true
+		}
+	}
+	return visible
+}
+
+// modelExposedFields returns the set of field names the model itself allows
+// to be emitted, through FieldsExposer and FieldVisibilityByContext.
+func modelExposedFields(model interface{}, o *options) map[string]bool {
+	var exposed map[string]bool
+	if exposer, ok := model.(FieldsExposer); ok {
+		exposed = make(map[string]bool)
+		for _, name := range exposer.JSONAPIExposedFields() {
+			exposed[name] = true
+		}
+	}
+
+	visibility, ok := model.(FieldVisibilityByContext)
+	if !ok {
+		return exposed
+	}
+
+	// Attribute and relationship names share a namespace, so one set holds
+	// both; a field must also be exposed to be visible
+	attrs, rels := visibility.JSONAPIVisibleFields(o.requestContext())
+	visible := make(map[string]bool)
+	for _, name := range append(attrs, rels...) {
+		if exposed == nil || exposed[name] {
+			visible[name] = true
+		}
+	}
+	return visible
+}
+
+// isNilModel reports whether the related model v, possibly held by an
+// interface, is nil; such elements are skipped by visitModelNodeRelationships.
+func isNilModel(v reflect.Value) bool {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// linkageMeta returns the meta a related model wants attached to its resource
+// identifier within relationship linkage, if any.
+func linkageMeta(model interface{}) *Meta {
+	if provider, ok := model.(LinkageMetaProvider); ok {
+		return provider.JSONAPILinkageMeta()
+	}
+	return nil
+}
+
+// sortIncluded orders the included resources by type and then id, they are
+// otherwise in map order.
+func sortIncluded(payload Payloader) {
+	var included []*Node
+	switch p := payload.(type) {
+	case *OnePayload:
+		included = p.Included
+	case *ManyPayload:
+		included = p.Included
+	}
+
+	sortNodes(included)
+}
+
+// sortNodes sorts nodes by type, then id.
+func sortNodes(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Type != nodes[j].Type {
+			return nodes[i].Type < nodes[j].Type
+		}
+		return lessID(nodes[i].ID, nodes[j].ID)
+	})
+}
+
+// lessID orders ids numerically when both are unsigned integers, so "9" comes
+// before "10", and byte-wise otherwise.
+func lessID(a, b string) bool {
+	if isDigits(a) && isDigits(b) {
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+	}
+	return a < b
+}
+
+// isDigits reports whether s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sortLinkage sorts the linkage of every to-many relationship of the payload
+// by type, then id.
+func sortLinkage(payload Payloader) {
+	var nodes []*Node
+	switch p := payload.(type) {
+	case *OnePayload:
+		nodes = append([]*Node{p.Data}, p.Included...)
+	case *ManyPayload:
+		nodes = append(append([]*Node{}, p.Data...), p.Included...)
+	}
+
+	visited := make(map[*Node]bool)
+	for len(nodes) > 0 {
+		n := nodes[0]
+		nodes = nodes[1:]
+		if n == nil || visited[n] {
+			continue
+		}
+		visited[n] = true
+
+		for _, rel := range n.Relationships {
+			switch r := rel.(type) {
+			case *RelationshipOneNode:
+				nodes = append(nodes, r.Data)
+			case *RelationshipManyNode:
+				sortNodes(r.Data)
+				nodes = append(nodes, r.Data...)
+			}
+		}
+	}
+}
+
+// applyBaseURL prefixes every relative link in the payload, including those
+// of nested relationships and included resources, with base.
+func applyBaseURL(payload Payloader, base string) {
+	var nodes []*Node
+	switch p := payload.(type) {
+	case *OnePayload:
+		p.Links = p.Links.withBaseURL(base)
+		nodes = append([]*Node{p.Data}, p.Included...)
+	case *ManyPayload:
+		p.Links = p.Links.withBaseURL(base)
+		nodes = append(append([]*Node{}, p.Data...), p.Included...)
+	}
+
+	for len(nodes) > 0 {
+		n := nodes[0]
+		nodes = nodes[1:]
+		if n == nil {
+			continue
+		}
+
+		n.Links = n.Links.withBaseURL(base)
+		for _, rel := range n.Relationships {
+			switch r := rel.(type) {
+			case *RelationshipOneNode:
+				r.Links = r.Links.withBaseURL(base)
+				nodes = append(nodes, r.Data)
+			case *RelationshipManyNode:
+				r.Links = r.Links.withBaseURL(base)
+				nodes = append(nodes, r.Data...)
+			case *RelationshipLinksNode:
+				r.Links = r.Links.withBaseURL(base)
+			}
+		}
+	}
+}
+
+// applyTypeAliases renames the type of every resource and linkage in the
+// payload that has an alias.
+func applyTypeAliases(payload Payloader, aliases map[string]string) {
+	var nodes []*Node
+	switch p := payload.(type) {
+	case *OnePayload:
+		nodes = append([]*Node{p.Data}, p.Included...)
+	case *ManyPayload:
+		nodes = append(append([]*Node{}, p.Data...), p.Included...)
+	}
+
+	// A node may be reached more than once, e.g. as linkage of several
+	// resources, and must only be renamed once so aliases don't chain
+	renamed := make(map[*Node]bool)
+	for len(nodes) > 0 {
+		n := nodes[0]
+		nodes = nodes[1:]
+		if n == nil || renamed[n] {
+			continue
+		}
+		renamed[n] = true
+
+		if alias, ok := aliases[n.Type]; ok {
+			n.Type = alias
+		}
+		for _, rel := range n.Relationships {
+			switch r := rel.(type) {
+			case *RelationshipOneNode:
+				nodes = append(nodes, r.Data)
+			case *RelationshipManyNode:
+				nodes = append(nodes, r.Data...)
+			}
+		}
+	}
+}
+
+// copyRelationship returns a copy of the relationship node rel and of the
+// nodes it links to, so that they can be changed without affecting rel.
+func copyRelationship(rel interface{}) interface{} {
+	switch r := rel.(type) {
+	case *RelationshipOneNode:
+		c := *r
+		c.Data = copyNode(r.Data)
+		return &c
+	case *RelationshipManyNode:
+		c := *r
+		if r.Data != nil {
+			c.Data = make([]*Node, len(r.Data))
+			for i, n := range r.Data {
+				c.Data[i] = copyNode(n)
+			}
+		}
+		return &c
+	case *RelationshipLinksNode:
+		c := *r
+		return &c
+	}
+	return rel
+}
+
+// copyNode returns a copy of n with copies of its relationships.
+func copyNode(n *Node) *Node {
+	if n == nil {
+		return nil
+	}
+
+	c := *n
+	if n.Relationships != nil {
+		c.Relationships = make(map[string]interface{}, len(n.Relationships))
+		for name, rel := range n.Relationships {
+			c.Relationships[name] = copyRelationship(rel)
+		}
+	}
+	return &c
+}
+
 func toShallowNode(node *Node) *Node {
 	return &Node{
 		ID:   node.ID,
@@ -532,13 +2045,18 @@ func toShallowNode(node *Node) *Node {
 }
 
 func visitModelNodeRelationships(models reflect.Value, included *map[string]*Node,
-	sideload bool) (*RelationshipManyNode, error) {
+	sideload bool, depth int, o *options) (*RelationshipManyNode, error) {
 	nodes := []*Node{}
 
 	for i := 0; i < models.Len(); i++ {
+		// nil elements have no resource identifier to link to
+		if isNilModel(models.Index(i)) {
+			continue
+		}
+
 		n := models.Index(i).Interface()
 
-		node, err := visitModelNode(n, included, sideload)
+		node, err := visitModelNode(n, included, sideload, depth, o)
 		if err != nil {
 			return nil, err
 		}
@@ -563,6 +2081,16 @@ func appendIncluded(m *map[string]*Node, nodes ...*Node) {
 	}
 }
 
+// checkIncludedCount returns ErrIncludedTooLarge, wrapped with the counts, when
+// included holds more resources than WithMaxIncludedCount allows.
+func checkIncludedCount(included map[string]*Node, o *options) error {
+	if o.limitIncludedCount && len(included) > o.maxIncludedCount {
+		return fmt.Errorf("%w: %d resources, the maximum is %d",
+			ErrIncludedTooLarge, len(included), o.maxIncludedCount)
+	}
+	return nil
+}
+
 func nodeMapValues(m *map[string]*Node) []*Node {
 	mp := *m
 	nodes := make([]*Node, len(mp))
@@ -2,10 +2,17 @@ package jsonapi
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"reflect"
+	"runtime"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -302,6 +309,42 @@ func TestOmitsEmptyAnnotation(t *testing.T) {
 	}
 }
 
+func TestOmitsEmptyAnnotationOnStructAttribute(t *testing.T) {
+	type Address struct {
+		Street string   `json:"street"`
+		Lines  []string `json:"lines"`
+	}
+
+	type Customer struct {
+		ID      int     `jsonapi:"primary,customers"`
+		Name    string  `jsonapi:"attr,name"`
+		Address Address `jsonapi:"attr,address,omitempty"`
+	}
+
+	for _, c := range []struct {
+		customer *Customer
+		present  bool
+	}{
+		{&Customer{ID: 1, Name: "zero"}, false},
+		{&Customer{ID: 2, Name: "set", Address: Address{Street: "Main", Lines: []string{"1"}}}, true},
+	} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, c.customer); err != nil {
+			t.Fatal(err)
+		}
+
+		var jsonData map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+			t.Fatal(err)
+		}
+		attributes := jsonData["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+
+		if _, exists := attributes["address"]; exists != c.present {
+			t.Fatalf("Was expecting the data.attributes.address presence to be %v for %s", c.present, c.customer.Name)
+		}
+	}
+}
+
 func TestHasPrimaryAnnotation(t *testing.T) {
 	testModel := &Blog{
 		ID:        5,
@@ -359,6 +402,122 @@ func TestSupportsAttributes(t *testing.T) {
 	}
 }
 
+func TestMarshalIDComposite(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Widget{Tenant: "acme", Number: 42, Name: "sprocket"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "acme:42", resp.Data.ID; e != a {
+		t.Fatalf("Was expecting id %s, got %s", e, a)
+	}
+	if e, a := "widgets", resp.Data.Type; e != a {
+		t.Fatalf("Was expecting type %s, got %s", e, a)
+	}
+
+	if err := MarshalPayload(bytes.NewBuffer(nil), &Widget{Number: 42}); err == nil {
+		t.Fatal("Was expecting the JSONAPIID error to be returned")
+	}
+}
+
+func TestMarshalMetaFields(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Document{ID: 1, Title: "Final", Verified: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Data.Meta == nil {
+		t.Fatal("Was expecting meta")
+	}
+	meta := *resp.Data.Meta
+	if meta["verified"] != true {
+		t.Fatalf("Was expecting the readonly meta to be emitted, got %v", meta)
+	}
+	if _, exists := meta["revision"]; exists {
+		t.Fatal("Was expecting the empty revision meta to be omitted")
+	}
+	if _, exists := resp.Data.Attributes["verified"]; exists {
+		t.Fatal("Was not expecting meta fields in attributes")
+	}
+}
+
+func TestMarshalKeepID(t *testing.T) {
+	type Setting struct {
+		ID   *int   `jsonapi:"primary,settings"`
+		Name string `jsonapi:"attr,name"`
+	}
+	type RootSetting struct {
+		ID   *int   `jsonapi:"primary,settings,keepid"`
+		Name string `jsonapi:"attr,name"`
+	}
+
+	scenarios := []struct {
+		model    interface{}
+		expected string
+	}{
+		{&Setting{Name: "default"}, ""},
+		{&RootSetting{Name: "default"}, "0"},
+	}
+
+	for _, scenario := range scenarios {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, scenario.model); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := new(OnePayload)
+		if err := json.NewDecoder(out).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Data.ID != scenario.expected {
+			t.Fatalf("Was expecting id %q, got %q", scenario.expected, resp.Data.ID)
+		}
+		if resp.Data.Type != "settings" {
+			t.Fatalf("Was expecting type settings, got %q", resp.Data.Type)
+		}
+	}
+}
+
+func TestOmitEmptyUsesIsZeroMethod(t *testing.T) {
+	scenarios := []struct {
+		nickname NullableString
+		omitted  bool
+	}{
+		// reflect considers these non zero, but they are invalid
+		{NullableString{String: "stale"}, true},
+		{NullableString{}, true},
+		// and this zero-like string is valid
+		{NullableString{Valid: true}, false},
+	}
+
+	for _, scenario := range scenarios {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, &Contact{ID: 1, Nickname: scenario.nickname}); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := new(OnePayload)
+		if err := json.NewDecoder(out).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, exists := resp.Data.Attributes["nickname"]; exists == scenario.omitted {
+			t.Fatalf("Was expecting omitted to be %v for %#v", scenario.omitted, scenario.nickname)
+		}
+	}
+}
+
 func TestOmitsZeroTimes(t *testing.T) {
 	testModel := &Blog{
 		ID:        5,
@@ -387,6 +546,71 @@ func TestOmitsZeroTimes(t *testing.T) {
 	}
 }
 
+func TestKeepsZeroTimesAsNull(t *testing.T) {
+	type Event struct {
+		ID       int       `jsonapi:"primary,events"`
+		StartsAt time.Time `jsonapi:"attr,starts_at,iso8601,keepzero"`
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Event{ID: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	val, exists := resp.Data.Attributes["starts_at"]
+	if !exists {
+		t.Fatal("Was expecting the zero time to be kept")
+	}
+	if val != nil {
+		t.Fatalf("Was expecting the zero time to be null, got %v", val)
+	}
+}
+
+func TestOmitsZeroNumbersWithISO8601Times(t *testing.T) {
+	type Event struct {
+		ID       int       `jsonapi:"primary,events"`
+		Seats    int       `jsonapi:"attr,seats,omitempty"`
+		Price    float64   `jsonapi:"attr,price,omitempty"`
+		Capacity *int      `jsonapi:"attr,capacity,omitempty"`
+		StartsAt time.Time `jsonapi:"attr,starts_at,iso8601,omitempty"`
+	}
+
+	zero := 0
+	out := bytes.NewBuffer(nil)
+	event := &Event{
+		ID:       5,
+		Capacity: &zero,
+		StartsAt: time.Date(2016, 8, 17, 8, 27, 12, 0, time.UTC),
+	}
+	if err := MarshalPayload(out, event); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := resp.Data.Attributes
+	for _, name := range []string{"seats", "price"} {
+		if _, exists := attrs[name]; exists {
+			t.Fatalf("Was expecting the zero %s to be omitted", name)
+		}
+	}
+	// A pointer to zero is set, so it is kept
+	if attrs["capacity"] != float64(0) {
+		t.Fatalf("Was expecting the capacity to be kept, got %v", attrs["capacity"])
+	}
+	if attrs["starts_at"] != "2016-08-17T08:27:12Z" {
+		t.Fatalf("Was expecting the iso8601 starts_at, got %v", attrs["starts_at"])
+	}
+}
+
 func TestMarshalISO8601Time(t *testing.T) {
 	testModel := &Timestamp{
 		ID:   5,
@@ -414,6 +638,32 @@ func TestMarshalISO8601Time(t *testing.T) {
 	}
 }
 
+func TestMarshalDateOnly(t *testing.T) {
+	anniversary := time.Date(2015, 6, 1, 23, 59, 59, 0, time.UTC)
+	testModel := &Person{
+		ID:          5,
+		Birthday:    time.Date(1990, 4, 23, 8, 27, 12, 0, time.UTC),
+		Anniversary: &anniversary,
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testModel); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "1990-04-23", resp.Data.Attributes["dob"]; e != a {
+		t.Fatalf("Expected dob %v, got %v", e, a)
+	}
+	if e, a := "2015-06-01", resp.Data.Attributes["anniversary"]; e != a {
+		t.Fatalf("Expected anniversary %v, got %v", e, a)
+	}
+}
+
 func TestMarshalISO8601TimePointer(t *testing.T) {
 	tm := time.Date(2016, 8, 17, 8, 27, 12, 23849, time.UTC)
 	testModel := &Timestamp{
@@ -474,65 +724,1530 @@ func TestSupportsLinkable(t *testing.T) {
 		t.Fatal("Expected 'self' to contain a string")
 	}
 
-	comments, hasComments := links["comments"]
-	if !hasComments {
-		t.Fatal("expect 'comments' to be present")
+	comments, hasComments := links["comments"]
+	if !hasComments {
+		t.Fatal("expect 'comments' to be present")
+	}
+	commentsMap, isMap := comments.(map[string]interface{})
+	if !isMap {
+		t.Fatal("Expected 'comments' to contain a map")
+	}
+
+	commentsHref, hasHref := commentsMap["href"]
+	if !hasHref {
+		t.Fatal("Expect 'comments' to contain an 'href' key/value")
+	}
+	if _, isString := commentsHref.(string); !isString {
+		t.Fatal("Expected 'href' to contain a string")
+	}
+
+	commentsMeta, hasMeta := commentsMap["meta"]
+	if !hasMeta {
+		t.Fatal("Expect 'comments' to contain a 'meta' key/value")
+	}
+	commentsMetaMap, isMap := commentsMeta.(map[string]interface{})
+	if !isMap {
+		t.Fatal("Expected 'comments' to contain a map")
+	}
+
+	commentsMetaObject := Meta(commentsMetaMap)
+	countsMap, isMap := commentsMetaObject["counts"].(map[string]interface{})
+	if !isMap {
+		t.Fatal("Expected 'counts' to contain a map")
+	}
+	for k, v := range countsMap {
+		if _, isNum := v.(float64); !isNum {
+			t.Fatalf("Exepected value at '%s' to be a numeric (float64)", k)
+		}
+	}
+}
+
+func TestMarshalWithBaseURL(t *testing.T) {
+	chapter := &Chapter{ID: 1, Next: &Chapter{ID: 2}}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, chapter, WithBaseURL("https://api.example.com/")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	links := *resp.Data.Links
+	if e, a := "https://api.example.com/chapters/1", links["self"]; e != a {
+		t.Fatalf("Was expecting self link %s, got %v", e, a)
+	}
+	if e, a := "https://api.example.com/chapters/1/canonical", links["canonical"].(map[string]interface{})["href"]; e != a {
+		t.Fatalf("Was expecting canonical href %s, got %v", e, a)
+	}
+	if e, a := "https://example.org/books", links["external"]; e != a {
+		t.Fatalf("Was expecting the absolute link %s untouched, got %v", e, a)
+	}
+
+	next := resp.Data.Relationships["next"].(map[string]interface{})
+	related := next["links"].(map[string]interface{})["related"]
+	if e, a := "https://api.example.com/chapters/1/next", related; e != a {
+		t.Fatalf("Was expecting relationship link %s, got %v", e, a)
+	}
+
+	if len(resp.Included) != 1 {
+		t.Fatal("Was expecting the next chapter to be included")
+	}
+	if e, a := "https://api.example.com/chapters/2", (*resp.Included[0].Links)["self"]; e != a {
+		t.Fatalf("Was expecting included self link %s, got %v", e, a)
+	}
+}
+
+func TestInvalidLinkable(t *testing.T) {
+	testModel := &BadComment{
+		ID:   5,
+		Body: "Hello World",
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testModel); err == nil {
+		t.Fatal("Was expecting an error")
+	}
+}
+
+func TestSupportsMetable(t *testing.T) {
+	testModel := &Blog{
+		ID:        5,
+		Title:     "Title 1",
+		CreatedAt: time.Now(),
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testModel); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	data := resp.Data
+	if data.Meta == nil {
+		t.Fatalf("Expected data.meta")
+	}
+
+	meta := Meta(*data.Meta)
+	if e, a := "extra details regarding the blog", meta["detail"]; e != a {
+		t.Fatalf("Was expecting meta.detail to be %q, got %q", e, a)
+	}
+}
+
+func TestRelations(t *testing.T) {
+	testModel := testBlog()
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testModel); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	relations := resp.Data.Relationships
+
+	if relations == nil {
+		t.Fatalf("Relationships were not materialized")
+	}
+
+	if relations["posts"] == nil {
+		t.Fatalf("Posts relationship was not materialized")
+	} else {
+		if relations["posts"].(map[string]interface{})["links"] == nil {
+			t.Fatalf("Posts relationship links were not materialized")
+		}
+		if relations["posts"].(map[string]interface{})["meta"] == nil {
+			t.Fatalf("Posts relationship meta were not materialized")
+		}
+	}
+
+	if relations["current_post"] == nil {
+		t.Fatalf("Current post relationship was not materialized")
+	} else {
+		if relations["current_post"].(map[string]interface{})["links"] == nil {
+			t.Fatalf("Current post relationship links were not materialized")
+		}
+		if relations["current_post"].(map[string]interface{})["meta"] == nil {
+			t.Fatalf("Current post relationship meta were not materialized")
+		}
+	}
+
+	if len(relations["posts"].(map[string]interface{})["data"].([]interface{})) != 2 {
+		t.Fatalf("Did not materialize two posts")
+	}
+}
+
+func TestComputedRelationships(t *testing.T) {
+	author := &Author{
+		ID:          1,
+		Name:        "Ursula",
+		Recommended: []*Book{{ID: 7, Title: "Earthsea"}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, author); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	recommended, ok := resp.Data.Relationships["recommended"].(map[string]interface{})
+	if !ok {
+		t.Fatal("Was expecting the computed relationship to be present")
+	}
+	if e, a := 1, len(recommended["data"].([]interface{})); e != a {
+		t.Fatalf("Was expecting %d recommended books, got %d", e, a)
+	}
+
+	if len(resp.Included) != 1 {
+		t.Fatalf("Was expecting the computed relationship to be sideloaded")
+	}
+	if e, a := "Earthsea", resp.Included[0].Attributes["title"]; e != a {
+		t.Fatalf("Was expecting included title %s, got %v", e, a)
+	}
+}
+
+func TestFieldsExposer(t *testing.T) {
+	account := &Account{
+		ID:       1,
+		Email:    "jane@example.com",
+		Password: "hunter2",
+		Owner:    &Author{ID: 1, Name: "Jane"},
+		Auditor:  &Author{ID: 2, Name: "Carl"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, account); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := resp.Data.Attributes["password"]; exists {
+		t.Fatal("Was expecting the unexposed password attribute to be omitted")
+	}
+	if _, exists := resp.Data.Attributes["email"]; !exists {
+		t.Fatal("Was expecting the exposed email attribute to be present")
+	}
+	if _, exists := resp.Data.Relationships["auditor"]; exists {
+		t.Fatal("Was expecting the unexposed auditor relationship to be omitted")
+	}
+	if _, exists := resp.Data.Relationships["owner"]; !exists {
+		t.Fatal("Was expecting the exposed owner relationship to be present")
+	}
+	if len(resp.Included) != 1 || resp.Included[0].ID != "1" {
+		t.Fatal("Was expecting only the exposed owner to be sideloaded")
+	}
+}
+
+func TestLinkageMetaProvider(t *testing.T) {
+	owner := &Member{ID: 1, Name: "Ann", Role: "admin"}
+	group := &Group{
+		ID:      1,
+		Owner:   owner,
+		Members: []*Member{owner, {ID: 2, Name: "Bob", Role: "member"}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, group); err != nil {
+		t.Fatal(err)
+	}
+
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+	relationships := jsonData["data"].(map[string]interface{})["relationships"].(map[string]interface{})
+
+	ownerData := relationships["owner"].(map[string]interface{})["data"].(map[string]interface{})
+	if e, a := "admin", ownerData["meta"].(map[string]interface{})["role"]; e != a {
+		t.Fatalf("Was expecting owner linkage role %s, got %v", e, a)
+	}
+
+	members := relationships["members"].(map[string]interface{})["data"].([]interface{})
+	for i, role := range []string{"admin", "member"} {
+		meta := members[i].(map[string]interface{})["meta"].(map[string]interface{})
+		if meta["role"] != role {
+			t.Fatalf("Was expecting member %d linkage role %s, got %v", i, role, meta["role"])
+		}
+	}
+
+	for _, n := range jsonData["included"].([]interface{}) {
+		if _, exists := n.(map[string]interface{})["meta"]; exists {
+			t.Fatal("Was expecting linkage meta to be omitted from included resources")
+		}
+	}
+}
+
+func TestMarshalWithRelationshipPaginator(t *testing.T) {
+	paginator := PaginatorFunc(func(model interface{}) (int, int, *Links) {
+		blog := model.(*Blog)
+		return 42, 1, &Links{
+			KeyNextPage: fmt.Sprintf("https://example.com/api/blogs/%d/posts?page[number]=2", blog.ID),
+		}
+	})
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog(), WithRelationshipPaginator("posts", paginator)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := resp.Data.Relationships["posts"].(map[string]interface{})
+	meta := posts["meta"].(map[string]interface{})
+	if meta["count"] != float64(42) || meta["page"] != float64(1) {
+		t.Fatalf("Was expecting count and page meta, got %v", meta)
+	}
+	if _, exists := meta["this"]; !exists {
+		t.Fatal("Was expecting the RelationshipMetable meta to be kept")
+	}
+
+	links := posts["links"].(map[string]interface{})
+	if e, a := "https://example.com/api/blogs/5/posts?page[number]=2", links[KeyNextPage]; e != a {
+		t.Fatalf("Was expecting next link %s, got %v", e, a)
+	}
+	if _, exists := links["related"]; !exists {
+		t.Fatal("Was expecting the RelationshipLinkable links to be kept")
+	}
+
+	currentPost := resp.Data.Relationships["current_post"].(map[string]interface{})
+	if _, exists := currentPost["meta"].(map[string]interface{})["count"]; exists {
+		t.Fatal("Was not expecting other relationships to be paginated")
+	}
+}
+
+func TestMarshalSkipsNilRelationshipElements(t *testing.T) {
+	post := &Post{
+		ID:       1,
+		Title:    "Foo",
+		Comments: []*Comment{{ID: 1, Body: "foo"}, nil, {ID: 2, Body: "bar"}},
+	}
+
+	for _, sideload := range []bool{true, false} {
+		out := bytes.NewBuffer(nil)
+		var err error
+		if sideload {
+			err = MarshalPayload(out, post)
+		} else {
+			err = MarshalPayloadWithoutIncluded(out, post)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := new(OnePayload)
+		if err := json.NewDecoder(out).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+
+		comments := resp.Data.Relationships["comments"].(map[string]interface{})["data"].([]interface{})
+		if len(comments) != 2 {
+			t.Fatalf("Was expecting 2 comments, got %d", len(comments))
+		}
+	}
+}
+
+func TestMarshalNilRelationshipElementsKeepLinkageMeta(t *testing.T) {
+	group := &Group{
+		ID:      1,
+		Members: []*Member{{ID: 1, Role: "admin"}, nil, {ID: 2, Role: "member"}},
+	}
+	feed := &Feed{
+		ID:    1,
+		Items: []interface{}{&Member{ID: 1, Role: "admin"}, (*Member)(nil), nil, &Member{ID: 2, Role: "member"}},
+	}
+
+	for _, scenario := range []struct {
+		model interface{}
+		name  string
+	}{{group, "members"}, {feed, "items"}} {
+		payload, err := Marshal(scenario.model)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		linkage := payload.(*OnePayload).Data.Relationships[scenario.name].(*RelationshipManyNode).Data
+		if len(linkage) != 2 {
+			t.Fatalf("Was expecting 2 %s, got %d", scenario.name, len(linkage))
+		}
+		for i, role := range []string{"admin", "member"} {
+			if linkage[i].Meta == nil || (*linkage[i].Meta)["role"] != role {
+				t.Fatalf("Was expecting %s %d to have role %s, got %v", scenario.name, i, role, linkage[i].Meta)
+			}
+		}
+	}
+}
+
+func TestMarshalWithoutAttributes(t *testing.T) {
+	type Tag struct {
+		ID    int     `jsonapi:"primary,tags"`
+		Posts []*Post `jsonapi:"relation,posts"`
+		Owner *Author `jsonapi:"relation,owner"`
+		Count int     `jsonapi:"meta,count"`
+	}
+
+	out := bytes.NewBuffer(nil)
+	model := &Tag{ID: 1, Posts: []*Post{{ID: 2, Title: "Foo"}}, Count: 1}
+	if err := MarshalPayload(out, model); err != nil {
+		t.Fatal(err)
+	}
+
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+	data := jsonData["data"].(map[string]interface{})
+
+	if _, exists := data["attributes"]; exists {
+		t.Fatalf("Was expecting no attributes key, got %v", data["attributes"])
+	}
+	relationships, ok := data["relationships"].(map[string]interface{})
+	if !ok || relationships["posts"] == nil || relationships["owner"] == nil {
+		t.Fatalf("Was expecting the relationships to be serialized, got %v", data["relationships"])
+	}
+	if meta, ok := data["meta"].(map[string]interface{}); !ok || meta["count"] != float64(1) {
+		t.Fatalf("Was expecting the meta to be serialized, got %v", data["meta"])
+	}
+}
+
+func TestMarshalInlineUnlessIncluded(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog(), WithInlineUnlessIncluded("posts")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := resp.Data.Relationships["posts"].(map[string]interface{})["data"].([]interface{})
+	for _, p := range posts {
+		if _, exists := p.(map[string]interface{})["attributes"]; exists {
+			t.Fatal("Was expecting the included posts to be linked, not inlined")
+		}
+	}
+
+	currentPost := resp.Data.Relationships["current_post"].(map[string]interface{})["data"].(map[string]interface{})
+	if _, exists := currentPost["attributes"]; !exists {
+		t.Fatal("Was expecting the current_post to be inlined")
+	}
+
+	for _, n := range resp.Included {
+		if n.Type != "posts" {
+			t.Fatalf("Was expecting only posts to be included, got %s", n.Type)
+		}
+
+		// comments are not in the include list either, so are inlined in the
+		// included post
+		comments := n.Relationships["comments"].(map[string]interface{})["data"].([]interface{})
+		for _, c := range comments {
+			if _, exists := c.(map[string]interface{})["attributes"]; !exists {
+				t.Fatal("Was expecting the post comments to be inlined")
+			}
+		}
+	}
+	if len(resp.Included) != 2 {
+		t.Fatalf("Was expecting 2 included posts, got %d", len(resp.Included))
+	}
+}
+
+func TestMarshalPayloadFiltered(t *testing.T) {
+	data := []*Blog{
+		{ID: 5, Title: "Title 1"},
+		{ID: 6, Title: ""},
+		{ID: 7, Title: "Title 3"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	keep := func(model interface{}) bool {
+		return model.(*Blog).Title != ""
+	}
+	if err := MarshalPayloadFiltered(out, data, keep); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Data) != 2 || resp.Data[0].ID != "5" || resp.Data[1].ID != "7" {
+		t.Fatalf("Was expecting blogs 5 and 7, got %v", resp.Data)
+	}
+
+	if err := MarshalPayloadFiltered(out, data[0], keep); err != ErrExpectedSlice {
+		t.Fatalf("Was expecting ErrExpectedSlice, got %v", err)
+	}
+}
+
+func TestLinkObjectV11Members(t *testing.T) {
+	links := &Links{
+		"self": "https://example.com/articles/1",
+		"alternate": Link{
+			Href:        "https://example.com/fr/articles/1",
+			Rel:         "alternate",
+			Title:       "Article (French)",
+			Type:        "text/html",
+			Hreflang:    []string{"fr", "fr-CA"},
+			DescribedBy: Link{Href: "https://example.com/schemas/article", Type: "application/schema+json"},
+		},
+	}
+	if err := links.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := json.Marshal(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{
+		"self": "https://example.com/articles/1",
+		"alternate": {
+			"href": "https://example.com/fr/articles/1",
+			"rel": "alternate",
+			"title": "Article (French)",
+			"type": "text/html",
+			"hreflang": ["fr", "fr-CA"],
+			"describedby": {"href": "https://example.com/schemas/article", "type": "application/schema+json"}
+		}
+	}`
+	if ok, err := isJSONEqual(out, []byte(expected)); err != nil || !ok {
+		t.Fatalf("Got\n%s\nExpected\n%s\n", out, expected)
+	}
+
+	invalid := &Links{"alternate": Link{Href: "/fr", Hreflang: 1}}
+	if err := invalid.validate(); err == nil {
+		t.Fatal("Was expecting an error for a non string hreflang")
+	}
+}
+
+func TestMarshalWithMaxIncludeDepth(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog(), WithMaxIncludeDepth(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range resp.Included {
+		if n.Type != "posts" {
+			t.Fatalf("Was expecting only posts to be included at depth 1, got %s", n.Type)
+		}
+
+		comments := n.Relationships["comments"].(map[string]interface{})["data"].([]interface{})
+		if len(comments) == 0 {
+			t.Fatal("Was expecting the comments linkage to be kept")
+		}
+		for _, c := range comments {
+			if _, exists := c.(map[string]interface{})["attributes"]; exists {
+				t.Fatal("Was expecting the comments to be linked, not inlined")
+			}
+		}
+	}
+	if len(resp.Included) != 2 {
+		t.Fatalf("Was expecting 2 included posts, got %d", len(resp.Included))
+	}
+
+	out.Reset()
+	if err := MarshalPayload(out, testBlog(), WithMaxIncludeDepth(0)); err != nil {
+		t.Fatal(err)
+	}
+	resp = new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Included) != 0 {
+		t.Fatalf("Was expecting nothing included at depth 0, got %d", len(resp.Included))
+	}
+	if _, exists := resp.Data.Relationships["posts"]; !exists {
+		t.Fatal("Was expecting the posts linkage at depth 0")
+	}
+}
+
+func TestMarshalWithMaxDepth(t *testing.T) {
+	payload, err := Marshal(testBlog(), WithMaxDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	included := payload.(*OnePayload).Included
+	if len(included) != 2 {
+		t.Fatalf("Was expecting 2 included posts, got %d", len(included))
+	}
+	for _, n := range included {
+		if n.Type != "posts" || n.Attributes["title"] == nil {
+			t.Fatalf("Was expecting the posts to be visited, got %+v", n)
+		}
+		comments := n.Relationships["comments"].(*RelationshipManyNode).Data
+		if len(comments) == 0 {
+			t.Fatal("Was expecting the comments to be linked")
+		}
+	}
+
+	blog, err := visitModelNode(testBlog(), nil, false, 0, newOptions([]Option{WithMaxDepth(1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := blog.Relationships["posts"].(*RelationshipManyNode).Data[0]
+	comment := post.Relationships["comments"].(*RelationshipManyNode).Data[0]
+	if comment.ID == "" || comment.Attributes != nil || comment.Relationships != nil {
+		t.Fatalf("Was expecting only the comment's identifier past the maximum depth, got %+v", comment)
+	}
+}
+
+func TestMarshalCyclicRelationships(t *testing.T) {
+	a := &Category{ID: 1, Name: "a"}
+	b := &Category{ID: 2, Name: "b", Parent: a}
+	a.Parent = b
+
+	payload, err := Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := payload.(*OnePayload)
+	if parent := one.Data.Relationships["parent"].(*RelationshipOneNode).Data; parent.ID != "2" {
+		t.Fatalf("Was expecting a's parent to be b, got %+v", parent)
+	}
+	if len(one.Included) != 1 || one.Included[0].ID != "2" {
+		t.Fatalf("Was expecting only b to be included, got %+v", one.Included)
+	}
+	if parent := one.Included[0].Relationships["parent"].(*RelationshipOneNode).Data; parent.ID != "1" {
+		t.Fatalf("Was expecting b's parent to be linked to a, got %+v", parent)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalOnePayloadEmbedded(out, a); err != nil {
+		t.Fatal(err)
+	}
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	parent := resp.Data.Relationships["parent"].(map[string]interface{})["data"].(map[string]interface{})
+	grandparent := parent["relationships"].(map[string]interface{})["parent"].(map[string]interface{})["data"].(map[string]interface{})
+	if grandparent["id"] != "1" || grandparent["attributes"] != nil {
+		t.Fatalf("Was expecting the cycle back to a to be linked only, got %v", grandparent)
+	}
+}
+
+func TestMarshalWithCanonicalOutput(t *testing.T) {
+	blog := testBlog()
+
+	var outputs []string
+	for i := 0; i < 5; i++ {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, blog, WithCanonicalOutput()); err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, out.String())
+	}
+	for _, o := range outputs[1:] {
+		if o != outputs[0] {
+			t.Fatalf("Was expecting identical output, got\n%s\n%s", outputs[0], o)
+		}
+	}
+
+	resp := new(OnePayload)
+	if err := json.Unmarshal([]byte(outputs[0]), resp); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, n := range resp.Included {
+		keys = append(keys, n.Type+","+n.ID)
+	}
+	expected := []string{"comments,1", "comments,2", "comments,3", "posts,1", "posts,2"}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatalf("Was expecting included %v, got %v", expected, keys)
+	}
+
+	post := &Post{ID: 1, Comments: []*Comment{{ID: 10}, {ID: 9}, {ID: 100}}}
+	payload, err := Marshal(post, WithCanonicalOutput())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = nil
+	for _, n := range payload.(*OnePayload).Included {
+		keys = append(keys, n.ID)
+	}
+	if expected := []string{"9", "10", "100"}; !reflect.DeepEqual(expected, keys) {
+		t.Fatalf("Was expecting numeric ids sorted numerically %v, got %v", expected, keys)
+	}
+}
+
+func TestNodeMarshalJSONMemberOrder(t *testing.T) {
+	node := &Node{
+		Meta:          &Meta{"b": 1, "a": 2},
+		Links:         &Links{"self": "/posts/1"},
+		Relationships: map[string]interface{}{"comments": &RelationshipManyNode{Data: []*Node{}}},
+		Attributes:    map[string]interface{}{"title": "Title", "body": "Body"},
+		ID:            "1",
+		Type:          "posts",
+	}
+
+	out, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"type":"posts","id":"1","attributes":{"body":"Body","title":"Title"},` +
+		`"relationships":{"comments":{"data":[]}},"links":{"self":"/posts/1"},"meta":{"a":2,"b":1}}`
+	if string(out) != expected {
+		t.Fatalf("Was expecting\n%s\ngot\n%s", expected, out)
+	}
+
+	if out, err := json.Marshal(Node{Type: "posts"}); err != nil || string(out) != `{"type":"posts"}` {
+		t.Fatalf("Was expecting the empty members to be omitted, got %s %v", out, err)
+	}
+}
+
+// streamPosts sends n posts whose latest comments are among a few shared ones.
+func streamPosts(n int) <-chan interface{} {
+	models := make(chan interface{})
+	go func() {
+		defer close(models)
+		for i := 1; i <= n; i++ {
+			comment := &Comment{ID: i % 3, Body: fmt.Sprintf("Comment %d", i%3)}
+			models <- &Post{ID: uint64(i), Title: fmt.Sprintf("Post %d", i), LatestComment: comment}
+		}
+	}()
+	return models
+}
+
+// flushCounter counts the flushes of a gzip writer.
+type flushCounter struct {
+	*gzip.Writer
+	flushes int
+}
+
+func (f *flushCounter) Flush() error {
+	f.flushes++
+	return f.Writer.Flush()
+}
+
+func TestStreamMarshalMany(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	zw := &flushCounter{Writer: gzip.NewWriter(buf)}
+	if err := StreamMarshalMany(zw, streamPosts(250)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if zw.flushes != 3 {
+		t.Fatalf("Was expecting 3 flushes, got %d", zw.flushes)
+	}
+
+	zr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(zr).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Data) != 250 {
+		t.Fatalf("Was expecting 250 posts, got %d", len(resp.Data))
+	}
+	for i, n := range resp.Data {
+		if e, a := fmt.Sprintf("%d", i+1), n.ID; e != a {
+			t.Fatalf("Was expecting post %s at %d, got %s", e, i, a)
+		}
+	}
+	if len(resp.Included) != 3 {
+		t.Fatalf("Was expecting the 3 shared comments to be included once, got %d", len(resp.Included))
+	}
+}
+
+func TestStreamMarshalManyEmpty(t *testing.T) {
+	models := make(chan interface{})
+	close(models)
+
+	out := bytes.NewBuffer(nil)
+	if err := StreamMarshalMany(out, models); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := "{\"data\":[]}\n", out.String(); e != a {
+		t.Fatalf("Was expecting %s, got %s", e, a)
+	}
+}
+
+func TestStreamMarshalManyWithoutIncluded(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := StreamMarshalMany(out, streamPosts(10), WithMaxIncludeDepth(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Data) != 10 {
+		t.Fatalf("Was expecting 10 posts, got %d", len(resp.Data))
+	}
+	if resp.Included != nil {
+		t.Fatalf("Was expecting no included resources, got %d", len(resp.Included))
+	}
+	if _, exists := resp.Data[0].Relationships["latest_comment"]; !exists {
+		t.Fatal("Was expecting the related comment to still be linked")
+	}
+}
+
+func BenchmarkStreamMarshalMany(b *testing.B) {
+	var peak uint64
+	var stats runtime.MemStats
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		models := make(chan interface{})
+		go func() {
+			defer close(models)
+			for post := range streamPosts(100000) {
+				if post.(*Post).ID%10000 == 0 {
+					runtime.ReadMemStats(&stats)
+					if stats.HeapInuse > peak {
+						peak = stats.HeapInuse
+					}
+				}
+				models <- post
+			}
+		}()
+
+		zw := gzip.NewWriter(ioutil.Discard)
+		if err := StreamMarshalMany(zw, models); err != nil {
+			b.Fatal(err)
+		}
+		zw.Close()
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+}
+
+func BenchmarkMarshalManyBlogs(b *testing.B) {
+	blogs := make([]*Blog, 1000)
+	for i := range blogs {
+		blogs[i] = testBlog()
+		blogs[i].ID = i
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := MarshalPayload(ioutil.Discard, blogs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalManyBlogs(b *testing.B) {
+	blogs := make([]*Blog, 1000)
+	for i := range blogs {
+		blogs[i] = testBlog()
+		blogs[i].ID = i
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, blogs); err != nil {
+		b.Fatal(err)
+	}
+	data := out.Bytes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := UnmarshalManyPayload(bytes.NewReader(data), reflect.TypeOf(new(Blog))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalPayloadWithTotal(t *testing.T) {
+	blogs := Blogs{testBlog(), testBlog()}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithTotal(out, blogs, 57); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Meta{"page-size": float64(2), KeyTotalCount: float64(57)}
+	if !reflect.DeepEqual(expected, resp.Meta) {
+		t.Fatalf("Was expecting meta %v, got %v", expected, resp.Meta)
+	}
+
+	if err := MarshalPayloadWithTotal(out, testBlog(), 1); err != ErrExpectedSlice {
+		t.Fatalf("Was expecting ErrExpectedSlice, got %v", err)
+	}
+}
+
+func TestMarshalPayloadWithVersion(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Comment{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"jsonapi"`) {
+		t.Fatalf("Was expecting no jsonapi object by default, got %s", out.String())
+	}
+
+	for _, models := range []interface{}{&Comment{ID: 1}, []*Comment{{ID: 1}}} {
+		out.Reset()
+		if err := MarshalPayloadWithVersion(out, models, "1.1"); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), `"jsonapi":{"version":"1.1"}`) {
+			t.Fatalf("Was expecting the jsonapi object, got %s", out.String())
+		}
+
+		version, err := DocumentVersion(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != "1.1" {
+			t.Fatalf("Was expecting version 1.1, got %q", version)
+		}
+	}
+
+	out.Reset()
+	if err := MarshalPayloadWithVersion(out, &Comment{ID: 1, Body: "hi"}, "1.1"); err != nil {
+		t.Fatal(err)
+	}
+	comment := new(Comment)
+	if err := UnmarshalPayload(out, comment); err != nil {
+		t.Fatal(err)
+	}
+	if comment.Body != "hi" {
+		t.Fatalf("Was expecting the body to be unmarshaled, got %q", comment.Body)
+	}
+}
+
+func TestMarshalResourceMetaPrecedence(t *testing.T) {
+	metaFn := func(model interface{}) *Meta {
+		return &Meta{"user": "override", "editable": model.(*Dashboard).ID == 1}
+	}
+
+	ctx := context.WithValue(context.Background(), userKey{}, "ann")
+	payload, err := Marshal(&Dashboard{ID: 1, Version: 3, Source: "field"},
+		withContext(ctx), withResourceMeta(metaFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Meta{
+		"version":  3,          // tagged field only
+		"cached":   true,       // Metable only
+		"source":   "computed", // computed wins over Metable and the field
+		"user":     "override", // call-time wins over computed
+		"editable": true,       // call-time only
+	}
+	if meta := payload.(*OnePayload).Data.Meta; !reflect.DeepEqual(&expected, meta) {
+		t.Fatalf("Was expecting meta %v, got %v", expected, meta)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithResourceMeta(out, &Dashboard{ID: 2}, metaFn); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"editable":false`) {
+		t.Fatalf("Was expecting the call-time meta, got %s", out.String())
+	}
+}
+
+func TestMarshalWithSortedLinkage(t *testing.T) {
+	post := &Post{
+		ID: 1,
+		Comments: []*Comment{
+			{ID: 3, Body: "c"},
+			{ID: 1, Body: "a"},
+			{ID: 2, Body: "b"},
+		},
+	}
+
+	linkage := func(opts ...Option) []string {
+		payload, err := Marshal(post, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		rel := payload.(*OnePayload).Data.Relationships["comments"].(*RelationshipManyNode)
+		for _, n := range rel.Data {
+			ids = append(ids, n.ID)
+		}
+		return ids
+	}
+
+	if e, a := []string{"3", "1", "2"}, linkage(); !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting the slice order %v by default, got %v", e, a)
+	}
+	if e, a := []string{"1", "2", "3"}, linkage(WithSortedLinkage()); !reflect.DeepEqual(e, a) {
+		t.Fatalf("Was expecting the sorted linkage %v, got %v", e, a)
+	}
+	if post.Comments[0].ID != 3 {
+		t.Fatal("Was expecting the model's slice to be left untouched")
+	}
+}
+
+func TestMarshalWithMaxIncludedCount(t *testing.T) {
+	blog := testBlog()
+
+	payload, err := Marshal(blog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := len(payload.(*OnePayload).Included)
+
+	if _, err := Marshal(blog, WithMaxIncludedCount(count)); err != nil {
+		t.Fatalf("Was expecting %d included resources to be allowed, got %v", count, err)
+	}
+
+	_, err = Marshal(blog, WithMaxIncludedCount(count-1))
+	if !errors.Is(err, ErrIncludedTooLarge) {
+		t.Fatalf("Was expecting ErrIncludedTooLarge, got %v", err)
+	}
+
+	_, err = Marshal([]interface{}{blog}, WithMaxIncludedCount(count-1))
+	if !errors.Is(err, ErrIncludedTooLarge) {
+		t.Fatalf("Was expecting ErrIncludedTooLarge for a collection, got %v", err)
+	}
+}
+
+func TestMarshalIDGenerator(t *testing.T) {
+	notices := []*Notice{{Text: "maintenance"}, {ID: "42", Text: "outage"}}
+
+	payload, err := Marshal(notices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := payload.(*ManyPayload).Data
+	if e, a := "generated-maintenance", data[0].ID; e != a {
+		t.Fatalf("Was expecting the generated id %q, got %q", e, a)
+	}
+	if e, a := "42", data[1].ID; e != a {
+		t.Fatalf("Was expecting the model's id %q, got %q", e, a)
+	}
+	if notices[0].ID != "" {
+		t.Fatalf("Was expecting the model to be left untouched, got id %q", notices[0].ID)
+	}
+}
+
+func TestMarshalPayloadFlat(t *testing.T) {
+	post := &Post{
+		ID:            1,
+		Title:         "Title",
+		Body:          "Body",
+		LatestComment: &Comment{ID: 2, Body: "first"},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadFlat(out, post); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp map[string]map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 {
+		t.Fatalf("Was expecting only data, got %v", resp)
+	}
+
+	data := resp["data"]
+	if data["type"] != "posts" || data["id"] != "1" {
+		t.Fatalf("Was expecting the resource identity, got %v", data)
+	}
+	if data["title"] != "Title" || data["body"] != "Body" {
+		t.Fatalf("Was expecting the attributes at the top level, got %v", data)
+	}
+	if _, ok := data["attributes"]; ok {
+		t.Fatal("Was expecting no attributes member")
+	}
+
+	rels := data["relationships"].(map[string]interface{})
+	latest := rels["latest_comment"].(map[string]interface{})["data"].(map[string]interface{})
+	if latest["id"] != "2" {
+		t.Fatalf("Was expecting the relationship linkage to be kept, got %v", latest)
+	}
+
+	if err := MarshalPayloadFlat(out, []*Post{post}); err != ErrUnexpectedType {
+		t.Fatalf("Was expecting ErrUnexpectedType, got %v", err)
+	}
+}
+
+func TestMarshalTopLevelMeta(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, &Receipt{ID: 1, Title: "Title"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(OnePayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Meta == nil || (*resp.Meta)["request-id"] != "abc" || (*resp.Meta)["generated"] != nil {
+		t.Fatalf("Was expecting only the top-level meta in the document meta, got %v", resp.Meta)
+	}
+	if resp.Data.Meta == nil || (*resp.Data.Meta)["generated"] != true || (*resp.Data.Meta)["request-id"] != nil {
+		t.Fatalf("Was expecting only the resource meta in the resource, got %v", resp.Data.Meta)
+	}
+}
+
+func TestMarshalSize(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, testBlog(), WithMaxIncludeDepth(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := MarshalSize(testBlog(), WithMaxIncludeDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(out.Len()) {
+		t.Fatalf("Was expecting a size of %d, got %d", out.Len(), size)
+	}
+
+	if _, err := MarshalSize(&BadModel{}); err == nil {
+		t.Fatal("Was expecting an error for a bad model")
+	}
+}
+
+func TestMarshalRelationshipElementFilter(t *testing.T) {
+	moderated := &Moderated{
+		ID: 1,
+		Comments: []*Comment{
+			{ID: 1, Body: "visible"},
+			{ID: 2, Body: "hidden"},
+			{ID: 3, Body: "visible"},
+		},
+		Hidden: map[int]bool{2: true},
+	}
+
+	payload, err := Marshal(moderated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := payload.(*OnePayload)
+	var ids []string
+	for _, n := range one.Data.Relationships["comments"].(*RelationshipManyNode).Data {
+		ids = append(ids, n.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Fatalf("Was expecting the hidden comment to be left out of the linkage, got %v", ids)
+	}
+	if len(one.Included) != 2 {
+		t.Fatalf("Was expecting 2 included comments, got %d", len(one.Included))
+	}
+	for _, n := range one.Included {
+		if n.ID == "2" {
+			t.Fatal("Was expecting the hidden comment to be left out of included")
+		}
+	}
+	if len(moderated.Comments) != 3 {
+		t.Fatal("Was expecting the models' slice to be left untouched")
+	}
+}
+
+func TestMarshalMapRelation(t *testing.T) {
+	discussion := &Discussion{
+		ID: 1,
+		Comments: map[string]*Comment{
+			"3": {ID: 3, Body: "third"},
+			"1": {ID: 1, Body: "first"},
+			"2": {ID: 2, Body: "second"},
+		},
+	}
+
+	payload, err := Marshal(discussion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := payload.(*OnePayload)
+	linkage := one.Data.Relationships["comments"].(*RelationshipManyNode).Data
+	var ids []string
+	for _, n := range linkage {
+		ids = append(ids, n.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "2", "3"}) {
+		t.Fatalf("Was expecting the linkage in key order, got %v", ids)
+	}
+	if len(one.Included) != 3 {
+		t.Fatalf("Was expecting 3 included comments, got %d", len(one.Included))
+	}
+
+	payload, err = Marshal(&Discussion{ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := payload.(*OnePayload).Data.Relationships["comments"].(*RelationshipManyNode).Data; len(data) != 0 {
+		t.Fatalf("Was expecting empty linkage for a nil map, got %v", data)
+	}
+}
+
+func TestMarshalAttributeLinks(t *testing.T) {
+	draft := &Draft{ID: 1, Title: "Title"}
+
+	payload, err := Marshal(draft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload.(*OnePayload).Data.Attributes["_links"]; ok {
+		t.Fatal("Was expecting no attribute links without the option")
+	}
+
+	for key, expected := range map[string]string{"": "_links", "actions": "actions"} {
+		payload, err := Marshal(draft, WithAttributeLinks(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		attrs := payload.(*OnePayload).Data.Attributes
+		links, ok := attrs[expected].(map[string]string)
+		if !ok || links["publish"] != "/drafts/1/publish" {
+			t.Fatalf("Was expecting the publish link under %q, got %v", expected, attrs)
+		}
+		if attrs["title"] != "Title" {
+			t.Fatalf("Was expecting the other attributes to be kept, got %v", attrs)
+		}
+	}
+}
+
+func TestMarshalLinkOnlyRelationship(t *testing.T) {
+	thread := &Thread{
+		ID:      1,
+		Replies: []*Comment{{ID: 2, Body: "first"}},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, thread, WithBaseURL("https://example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp map[string]map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp["included"]; ok {
+		t.Fatal("Was expecting the link only relationship not to be sideloaded")
+	}
+
+	rels := resp["data"]["relationships"].(map[string]interface{})
+	replies := rels["replies"].(map[string]interface{})
+	if _, ok := replies["data"]; ok {
+		t.Fatalf("Was expecting no data for replies, got %v", replies)
+	}
+	links := replies["links"].(map[string]interface{})
+	if e, a := "https://example.com/threads/1/replies", links["related"]; e != a {
+		t.Fatalf("Was expecting related link %q, got %v", e, a)
+	}
+
+	// Without links the relationship is emitted as usual
+	starter := rels["starter"].(map[string]interface{})
+	if data, ok := starter["data"]; !ok || data != nil {
+		t.Fatalf("Was expecting null data for starter, got %v", starter)
+	}
+}
+
+func TestRegisterTypeAttributeHook(t *testing.T) {
+	defer UnregisterTypeAttributeHook("quotes")
+	RegisterTypeAttributeHook("quotes", func(attrs map[string]interface{}) {
+		for k, v := range attrs {
+			if f, ok := v.(float64); ok {
+				attrs[k] = math.Round(f*100) / 100
+			}
+		}
+		delete(attrs, "subtotal")
+	})
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, []*Quote{{ID: 1, Subtotal: 3.3333, Total: 9.999}}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := resp.Data[0].Attributes
+	if got := attrs["total"]; got != 10.0 {
+		t.Fatalf("Was expecting a rounded total of 10, got %v", got)
+	}
+	if _, ok := attrs["subtotal"]; ok {
+		t.Fatal("Was expecting the hook to delete subtotal")
+	}
+
+	// Other resource types are left untouched
+	out.Reset()
+	if err := MarshalPayload(out, &Invoice{ID: 1, Total: Money{Cents: 999, Currency: "EUR"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"currency":"EUR"`) {
+		t.Fatalf("Was expecting the invoice to be left alone, got %s", out.String())
+	}
+
+	UnregisterTypeAttributeHook("quotes")
+	payload, err := Marshal(&Quote{ID: 1, Subtotal: 3.3333})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payload.(*OnePayload).Data.Attributes["subtotal"]; got != 3.3333 {
+		t.Fatalf("Was expecting the unregistered hook to no longer run, got %v", got)
+	}
+}
+
+func TestMarshalPayloadWithExtraRelationships(t *testing.T) {
+	extra := map[string]interface{}{
+		"recommended": &RelationshipManyNode{
+			Data: []*Node{{Type: "blogs", ID: "7"}, {Type: "blogs", ID: "8"}},
+		},
+		"featured": &RelationshipOneNode{},
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithExtraRelationships(out, testBlog(), extra); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		Data struct {
+			Relationships map[string]json.RawMessage `json:"relationships"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(out).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"recommended": `{"data":[{"type":"blogs","id":"7"},{"type":"blogs","id":"8"}]}`,
+		"featured":    `{"data":null}`,
+	}
+	for name, e := range expected {
+		if a := string(resp.Data.Relationships[name]); e != a {
+			t.Fatalf("Was expecting %s %s, got %s", name, e, a)
+		}
+	}
+	if _, exists := resp.Data.Relationships["posts"]; !exists {
+		t.Fatal("Was expecting the field relationships to be kept")
+	}
+
+	invalid := map[string]interface{}{
+		"recommended": &RelationshipManyNode{Data: []*Node{{Type: "blogs"}}},
+	}
+	if err := MarshalPayloadWithExtraRelationships(out, testBlog(), invalid); !errors.Is(err, ErrInvalidRelationship) {
+		t.Fatalf("Was expecting ErrInvalidRelationship, got %v", err)
+	}
+	if err := MarshalPayloadWithExtraRelationships(out, []*Blog{testBlog()}, extra); err != ErrUnexpectedType {
+		t.Fatalf("Was expecting ErrUnexpectedType, got %v", err)
+	}
+
+	// The caller's relationships are left untouched by the rewrites
+	links := &Links{"related": "/blogs/1/recommended"}
+	recommended := &RelationshipManyNode{
+		Data:  []*Node{{Type: "blogs", ID: "8"}, {Type: "blogs", ID: "7"}},
+		Links: links,
+	}
+	out.Reset()
+	if err := MarshalPayloadWithTypeAliases(out, testBlog(), map[string]string{"blogs": "weblogs"},
+		WithBaseURL("https://example.com"), WithSortedLinkage(),
+		withExtraRelationships(map[string]interface{}{"recommended": recommended})); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"recommended":{"data":[{"type":"weblogs","id":"7"},{"type":"weblogs","id":"8"}]`) {
+		t.Fatalf("Was expecting the rewritten relationship in the output, got %s", out.String())
+	}
+	if recommended.Data[0].ID != "8" || recommended.Data[0].Type != "blogs" || recommended.Links != links ||
+		(*links)["related"] != "/blogs/1/recommended" {
+		t.Fatalf("Was expecting the caller's relationship to be unchanged, got %+v %v", recommended.Data[0], *recommended.Links)
+	}
+}
+
+func TestMarshalPayloadWithMetaFunc(t *testing.T) {
+	blogs := Blogs{
+		&Blog{ID: 1, Title: "Title 1", ViewCount: 12},
+		&Blog{ID: 2, Title: "Title 2", ViewCount: 4},
+	}
+
+	viewRange := func(models interface{}) *Meta {
+		min, max := -1, 0
+		for _, b := range models.(Blogs) {
+			if min < 0 || b.ViewCount < min {
+				min = b.ViewCount
+			}
+			if b.ViewCount > max {
+				max = b.ViewCount
+			}
+		}
+		return &Meta{"min-views": min, "max-views": max}
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayloadWithMetaFunc(out, blogs, viewRange); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Meta{"page-size": float64(2), "min-views": float64(4), "max-views": float64(12)}
+	if !reflect.DeepEqual(expected, resp.Meta) {
+		t.Fatalf("Was expecting meta %v, got %v", expected, resp.Meta)
+	}
+}
+
+func TestMarshalPayloadContext(t *testing.T) {
+	employee := &Employee{ID: 1, Name: "Ann", Salary: 100, Manager: &Employee{ID: 2, Name: "Bob", Salary: 200}}
+
+	scenarios := []struct {
+		ctx       context.Context
+		salary    bool
+		relations int
+	}{
+		{context.Background(), false, 0},
+		{context.WithValue(context.Background(), roleKey{}, "admin"), true, 1},
+	}
+
+	for _, scenario := range scenarios {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayloadContext(scenario.ctx, out, employee); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := new(OnePayload)
+		if err := json.NewDecoder(out).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, exists := resp.Data.Attributes["salary"]; exists != scenario.salary {
+			t.Fatalf("Was expecting salary visibility %v, got %v", scenario.salary, resp.Data.Attributes)
+		}
+		if resp.Data.Attributes["name"] != "Ann" {
+			t.Fatalf("Was expecting the name to be visible, got %v", resp.Data.Attributes)
+		}
+		if len(resp.Data.Relationships) != scenario.relations {
+			t.Fatalf("Was expecting %d relationships, got %v", scenario.relations, resp.Data.Relationships)
+		}
+		for _, n := range resp.Included {
+			if _, exists := n.Attributes["salary"]; exists != scenario.salary {
+				t.Fatalf("Was expecting included salary visibility %v, got %v", scenario.salary, n.Attributes)
+			}
+		}
+	}
+
+	// The call-time option isn't appended into the caller's spare capacity
+	opts := make([]Option, 1, 2)
+	opts[0] = WithCanonicalOutput()
+	if err := MarshalPayloadContext(context.Background(), bytes.NewBuffer(nil), employee, opts...); err != nil {
+		t.Fatal(err)
 	}
-	commentsMap, isMap := comments.(map[string]interface{})
-	if !isMap {
-		t.Fatal("Expected 'comments' to contain a map")
+	if opts[:2][1] != nil {
+		t.Fatal("Was expecting the caller's options to be left alone")
 	}
+}
 
-	commentsHref, hasHref := commentsMap["href"]
-	if !hasHref {
-		t.Fatal("Expect 'comments' to contain an 'href' key/value")
-	}
-	if _, isString := commentsHref.(string); !isString {
-		t.Fatal("Expected 'href' to contain a string")
+func TestMarshalMixedLinkableElements(t *testing.T) {
+	models := []interface{}{
+		&Blog{ID: 1, Title: "Title 1"},
+		&Comment{ID: 2, Body: "Body 2"},
 	}
 
-	commentsMeta, hasMeta := commentsMap["meta"]
-	if !hasMeta {
-		t.Fatal("Expect 'comments' to contain a 'meta' key/value")
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, models); err != nil {
+		t.Fatal(err)
 	}
-	commentsMetaMap, isMap := commentsMeta.(map[string]interface{})
-	if !isMap {
-		t.Fatal("Expected 'comments' to contain a map")
+
+	resp := new(ManyPayload)
+	if err := json.NewDecoder(out).Decode(resp); err != nil {
+		t.Fatal(err)
 	}
 
-	commentsMetaObject := Meta(commentsMetaMap)
-	countsMap, isMap := commentsMetaObject["counts"].(map[string]interface{})
-	if !isMap {
-		t.Fatal("Expected 'counts' to contain a map")
+	if resp.Data[0].Links == nil || (*resp.Data[0].Links)["self"] != "https://example.com/api/blogs/1" {
+		t.Fatalf("Was expecting the blog's links, got %v", resp.Data[0].Links)
 	}
-	for k, v := range countsMap {
-		if _, isNum := v.(float64); !isNum {
-			t.Fatalf("Exepected value at '%s' to be a numeric (float64)", k)
-		}
+	if resp.Data[0].Meta == nil {
+		t.Fatal("Was expecting the blog's meta")
+	}
+	if resp.Data[1].Links != nil || resp.Data[1].Meta != nil {
+		t.Fatalf("Was expecting no links or meta for the comment, got %v %v", resp.Data[1].Links, resp.Data[1].Meta)
+	}
+	if resp.Links != nil || resp.Meta != nil {
+		t.Fatalf("Was expecting no top-level links or meta, got %v %v", resp.Links, resp.Meta)
 	}
 }
 
-func TestInvalidLinkable(t *testing.T) {
-	testModel := &BadComment{
-		ID:   5,
-		Body: "Hello World",
+func TestMarshalOmitEmptyRelationships(t *testing.T) {
+	scenarios := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, `{"books":{"data":[]},"owner":{"data":null}}`},
+		{[]Option{WithOmitEmptyRelationships()}, `{"books":{"data":[]}}`},
 	}
 
-	out := bytes.NewBuffer(nil)
-	if err := MarshalPayload(out, testModel); err == nil {
-		t.Fatal("Was expecting an error")
+	for _, scenario := range scenarios {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayload(out, &Shelf{ID: 1}, scenario.opts...); err != nil {
+			t.Fatal(err)
+		}
+
+		var resp struct {
+			Data struct {
+				Relationships json.RawMessage `json:"relationships"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(out).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(resp.Data.Relationships) != scenario.expected {
+			t.Fatalf("Was expecting relationships %s, got %s", scenario.expected, resp.Data.Relationships)
+		}
 	}
 }
 
-func TestSupportsMetable(t *testing.T) {
-	testModel := &Blog{
-		ID:        5,
-		Title:     "Title 1",
-		CreatedAt: time.Now(),
+func TestMarshalToManyLinkageOrder(t *testing.T) {
+	ids := []int{5, 3, 9, 1, 7}
+	post := &Post{ID: 1, Title: "Playlist"}
+	for _, id := range ids {
+		post.Comments = append(post.Comments, &Comment{ID: id, Body: fmt.Sprintf("Track %d", id)})
 	}
 
 	out := bytes.NewBuffer(nil)
-	if err := MarshalPayload(out, testModel); err != nil {
+	if err := MarshalPayload(out, post); err != nil {
 		t.Fatal(err)
 	}
 
@@ -541,22 +2256,84 @@ func TestSupportsMetable(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	data := resp.Data
-	if data.Meta == nil {
-		t.Fatalf("Expected data.meta")
+	linkage := resp.Data.Relationships["comments"].(map[string]interface{})["data"].([]interface{})
+	if len(linkage) != len(ids) {
+		t.Fatalf("Was expecting %d comments, got %d", len(ids), len(linkage))
 	}
+	for i, id := range ids {
+		if e, a := fmt.Sprintf("%d", id), linkage[i].(map[string]interface{})["id"]; e != a {
+			t.Fatalf("Was expecting comment %s at %d, got %v", e, i, a)
+		}
+	}
+	if len(resp.Included) != len(ids) {
+		t.Fatalf("Was expecting %d included comments, got %d", len(ids), len(resp.Included))
+	}
+}
 
-	meta := Meta(*data.Meta)
-	if e, a := "extra details regarding the blog", meta["detail"]; e != a {
-		t.Fatalf("Was expecting meta.detail to be %q, got %q", e, a)
+func TestMarshalPayloadWithFieldsets(t *testing.T) {
+	fields := map[string][]string{
+		"blogs": {"title", "posts"},
+		"posts": {"title", "comments"},
+	}
+
+	expected := map[string][]string{
+		"blogs":    {"posts", "title"},
+		"posts":    {"comments", "title"},
+		"comments": {"body", "post_id"},
+	}
+	keys := func(n *Node) []string {
+		names := []string{}
+		for k := range n.Attributes {
+			names = append(names, k)
+		}
+		for k := range n.Relationships {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, models := range []interface{}{testBlog(), []*Blog{testBlog()}} {
+		out := bytes.NewBuffer(nil)
+		if err := MarshalPayloadWithFieldsets(out, models, fields); err != nil {
+			t.Fatal(err)
+		}
+
+		var resp struct {
+			Data     json.RawMessage `json:"data"`
+			Included []*Node         `json:"included"`
+		}
+		if err := json.NewDecoder(out).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var data []*Node
+		if err := json.Unmarshal(resp.Data, &data); err != nil {
+			one := new(Node)
+			if err := json.Unmarshal(resp.Data, one); err != nil {
+				t.Fatal(err)
+			}
+			data = []*Node{one}
+		}
+
+		seen := map[string]bool{}
+		for _, n := range append(data, resp.Included...) {
+			seen[n.Type] = true
+			if e, a := expected[n.Type], keys(n); !reflect.DeepEqual(e, a) {
+				t.Fatalf("Was expecting %s fields %v, got %v", n.Type, e, a)
+			}
+		}
+		if len(seen) != len(expected) {
+			t.Fatalf("Was expecting resources of types %v, got %v", expected, seen)
+		}
 	}
 }
 
-func TestRelations(t *testing.T) {
-	testModel := testBlog()
+func TestMarshalPayloadWithTypeAliases(t *testing.T) {
+	aliases := map[string]string{"posts": "articles", "articles": "stories"}
 
 	out := bytes.NewBuffer(nil)
-	if err := MarshalPayload(out, testModel); err != nil {
+	if err := MarshalPayloadWithTypeAliases(out, testBlog(), aliases); err != nil {
 		t.Fatal(err)
 	}
 
@@ -565,36 +2342,29 @@ func TestRelations(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	relations := resp.Data.Relationships
-
-	if relations == nil {
-		t.Fatalf("Relationships were not materialized")
+	if resp.Data.Type != "blogs" {
+		t.Fatalf("Was expecting the unaliased type blogs, got %s", resp.Data.Type)
 	}
 
-	if relations["posts"] == nil {
-		t.Fatalf("Posts relationship was not materialized")
-	} else {
-		if relations["posts"].(map[string]interface{})["links"] == nil {
-			t.Fatalf("Posts relationship links were not materialized")
-		}
-		if relations["posts"].(map[string]interface{})["meta"] == nil {
-			t.Fatalf("Posts relationship meta were not materialized")
+	posts := resp.Data.Relationships["posts"].(map[string]interface{})["data"].([]interface{})
+	current := resp.Data.Relationships["current_post"].(map[string]interface{})["data"].(map[string]interface{})
+	for _, linkage := range append(posts, current) {
+		if typ := linkage.(map[string]interface{})["type"]; typ != "articles" {
+			t.Fatalf("Was expecting linkage of type articles, got %v", typ)
 		}
 	}
 
-	if relations["current_post"] == nil {
-		t.Fatalf("Current post relationship was not materialized")
-	} else {
-		if relations["current_post"].(map[string]interface{})["links"] == nil {
-			t.Fatalf("Current post relationship links were not materialized")
-		}
-		if relations["current_post"].(map[string]interface{})["meta"] == nil {
-			t.Fatalf("Current post relationship meta were not materialized")
+	var articles int
+	for _, n := range resp.Included {
+		switch n.Type {
+		case "articles":
+			articles++
+		case "posts", "stories":
+			t.Fatalf("Was expecting included posts to be aliased once, got %s", n.Type)
 		}
 	}
-
-	if len(relations["posts"].(map[string]interface{})["data"].([]interface{})) != 2 {
-		t.Fatalf("Did not materialize two posts")
+	if articles == 0 {
+		t.Fatal("Was expecting included articles")
 	}
 }
 
@@ -654,6 +2424,57 @@ func TestMarshalPayloadWithoutIncluded(t *testing.T) {
 	}
 }
 
+func TestMarshalClientIDMember(t *testing.T) {
+	comment := &Comment{ClientID: "123e4567-e89b-12d3-a456-426655440000", Body: "Hello World"}
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, comment, WithClientIDMember(LocalIDMember)); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw map[string]map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["data"]["lid"] != comment.ClientID {
+		t.Fatalf("Was expecting lid %s, got %v", comment.ClientID, raw["data"])
+	}
+	if _, exists := raw["data"]["client-id"]; exists {
+		t.Fatalf("Was not expecting a client-id member, got %v", raw["data"])
+	}
+
+	dst := new(Comment)
+	if err := UnmarshalPayload(bytes.NewReader(out.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.ClientID != "" {
+		t.Fatalf("Was expecting lid to be ignored by default, got %s", dst.ClientID)
+	}
+
+	dst = new(Comment)
+	if err := UnmarshalPayload(out, dst, WithClientIDMember(LocalIDMember)); err != nil {
+		t.Fatal(err)
+	}
+	if dst.ClientID != comment.ClientID {
+		t.Fatalf("Was expecting client id %s, got %s", comment.ClientID, dst.ClientID)
+	}
+}
+
+func TestUnsupportedClientIDMember(t *testing.T) {
+	comment := &Comment{ClientID: "123e4567-e89b-12d3-a456-426655440000", Body: "Hello World"}
+	opt := WithClientIDMember("cid")
+
+	out := bytes.NewBuffer(nil)
+	if err := MarshalPayload(out, comment, opt); !errors.Is(err, ErrUnsupportedClientIDMember) {
+		t.Fatalf("Was expecting ErrUnsupportedClientIDMember, got %v", err)
+	}
+
+	in := strings.NewReader(`{"data":{"type":"comments","id":"1"}}`)
+	if err := UnmarshalPayload(in, new(Comment), opt); !errors.Is(err, ErrUnsupportedClientIDMember) {
+		t.Fatalf("Was expecting ErrUnsupportedClientIDMember, got %v", err)
+	}
+}
+
 func TestMarshalPayload_many(t *testing.T) {
 	data := []interface{}{
 		&Blog{
@@ -805,6 +2626,45 @@ func TestMarshalMany_SliceOfInterfaceAndSliceOfStructsSameJSON(t *testing.T) {
 	}
 }
 
+func TestMarshalMany_ErrorIdentifiesModel(t *testing.T) {
+	models := []interface{}{
+		&Book{ID: 1},
+		&BadComment{ID: 2},
+	}
+
+	err := MarshalPayload(bytes.NewBuffer(nil), models)
+
+	mErr, ok := err.(*MarshalError)
+	if !ok {
+		t.Fatalf("Was expecting a *MarshalError, got %T", err)
+	}
+	if mErr.Index != 1 || mErr.Type != "bad-comment" || mErr.ID != "2" {
+		t.Fatalf("Unexpected error context %+v", mErr)
+	}
+	if mErr.Err == nil || !strings.Contains(err.Error(), mErr.Err.Error()) {
+		t.Fatalf("Was expecting the underlying error in %q", err)
+	}
+
+	stream := make(chan interface{}, len(models))
+	for _, model := range models {
+		stream <- model
+	}
+	close(stream)
+	err = StreamMarshalMany(bytes.NewBuffer(nil), stream)
+	if mErr, ok := err.(*MarshalError); !ok || mErr.Index != 1 || mErr.ID != "2" {
+		t.Fatalf("Was expecting the streamed model to be identified, got %+v", err)
+	}
+
+	type badIDStruct struct {
+		ID *bool `jsonapi:"primary,cars"`
+	}
+	id := true
+	err = MarshalPayload(bytes.NewBuffer(nil), []*badIDStruct{{ID: &id}})
+	if !errors.Is(err, ErrBadJSONAPIID) {
+		t.Fatalf("Was expecting the error to wrap ErrBadJSONAPIID, got %v", err)
+	}
+}
+
 func TestMarshal_InvalidIntefaceArgument(t *testing.T) {
 	out := new(bytes.Buffer)
 	if err := MarshalPayload(out, true); err != ErrUnexpectedType {
@@ -816,6 +2676,32 @@ func TestMarshal_InvalidIntefaceArgument(t *testing.T) {
 	if err := MarshalPayload(out, Book{}); err != ErrUnexpectedType {
 		t.Fatal("Was expecting an error")
 	}
+	var nilBook *Book
+	if err := MarshalPayload(out, &nilBook); err != ErrUnexpectedType {
+		t.Fatal("Was expecting an error")
+	}
+}
+
+func TestMarshal_PointerToPointer(t *testing.T) {
+	book := &Book{ID: 1, Author: "aren55555"}
+
+	direct := bytes.NewBuffer(nil)
+	if err := MarshalPayload(direct, book); err != nil {
+		t.Fatal(err)
+	}
+
+	indirect := bytes.NewBuffer(nil)
+	if err := MarshalPayload(indirect, &book); err != nil {
+		t.Fatal(err)
+	}
+
+	equal, err := isJSONEqual(direct.Bytes(), indirect.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal {
+		t.Fatalf("Got\n%s\nExpected\n%s\n", indirect.Bytes(), direct.Bytes())
+	}
 }
 
 func TestMergeNode(t *testing.T) {
@@ -1149,7 +3035,7 @@ func TestMarshalUnmarshalCompositeStruct(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if scenario.expected.(*Model).ID == scenario.dst.(*Model).ID {
+		if scenario.expected.(*Model).ID != scenario.dst.(*Model).ID {
 			t.Errorf("Expected matching ID's but were \n%#v\nAnd\n%#v\n", scenario.expected.(*Model).ID, scenario.dst.(*Model).ID)
 		}
 
@@ -1160,6 +3046,38 @@ func TestMarshalUnmarshalCompositeStruct(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalCompositeStruct_RoundTrip(t *testing.T) {
+	type Thing struct {
+		ID   int    `jsonapi:"primary,things"`
+		Fizz string `jsonapi:"attr,fizz,omitempty"`
+		Buzz int    `jsonapi:"attr,buzz,omitempty"`
+	}
+
+	type Model struct {
+		*Thing `jsonapi:"extends,models"`
+		Foo    string `jsonapi:"attr,foo"`
+		Buzz   int    `jsonapi:"attr,buzz,omitempty"` // overrides Thing.Buzz
+	}
+
+	in := &Model{Thing: &Thing{ID: 1, Fizz: "fizzy", Buzz: 5}, Foo: "fooey", Buzz: 99}
+
+	buf := bytes.NewBuffer(nil)
+	if err := MarshalPayload(buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &Model{}
+	if err := UnmarshalPayload(buf, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// The outer Buzz won on marshal, so both fields read it back
+	expected := &Model{Thing: &Thing{ID: 1, Fizz: "fizzy", Buzz: 99}, Foo: "fooey", Buzz: 99}
+	if !reflect.DeepEqual(expected, dst) {
+		t.Fatalf("Got\n%#v\n%#v\nExpected\n%#v\n%#v\n", dst, dst.Thing, expected, expected.Thing)
+	}
+}
+
 func TestExtendsWithRelation_MixedData(t *testing.T) {
 	type Thing struct {
 		ID   int    `jsonapi:"primary,things"`
@@ -1225,15 +3143,118 @@ func TestExtendsWithRelation_MixedData(t *testing.T) {
 
 	l := len(rels.([]interface{}))
 	if l != 2 {
-		t.Fatal("Was expecting 2 relations but there were %d", l)
+		t.Fatalf("Was expecting 2 relations but there were %d", l)
 	}
 	fmt.Println(string(out.Bytes()))
 
 	m := Model{Thing: new(Thing), Rels: make([]*Relation, 0)}
-	if err := UnmarshalPayload(out, m); err != nil {
+	if err := UnmarshalPayload(out, &m); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestUnmarshalCompositeStruct_NilEmbeddedPtr(t *testing.T) {
+	type Thing struct {
+		ID   int    `jsonapi:"primary,things"`
+		Fizz string `jsonapi:"attr,fizz,omitempty"`
+		Buzz int    `jsonapi:"attr,buzz,omitempty"`
+	}
+
+	type Model struct {
+		*Thing `jsonapi:"extends,models"`
+		Foo    string `jsonapi:"attr,foo"`
+	}
+
+	payload, err := json.Marshal(&OnePayload{
+		Data: &Node{
+			Type: "models",
+			ID:   "1",
+			Attributes: map[string]interface{}{
+				"buzz": 99,
+				"fizz": "fizzy",
+				"foo":  "fooey",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &Model{}
+	if err := UnmarshalPayload(bytes.NewReader(payload), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Thing == nil {
+		t.Fatal("Was expecting the embedded *Thing to be allocated")
+	}
+
+	expected := &Model{
+		Thing: &Thing{ID: 1, Fizz: "fizzy", Buzz: 99},
+		Foo:   "fooey",
+	}
+	if !reflect.DeepEqual(expected, dst) {
+		t.Fatalf("Got\n%#v\n%#v\nExpected\n%#v\n%#v\n", dst, dst.Thing, expected, expected.Thing)
+	}
+}
+
+func TestMarshalUnmarshalCompositeStruct_BaseIdentity(t *testing.T) {
+	type Thing struct {
+		ID   int    `jsonapi:"primary,things"`
+		Fizz string `jsonapi:"attr,fizz,omitempty"`
+	}
+
+	// Model has no primary field, its id comes from Thing
+	type Model struct {
+		*Thing `jsonapi:"extends,models"`
+		Foo    string `jsonapi:"attr,foo"`
+	}
+
+	expected := &Model{Thing: &Thing{ID: 7, Fizz: "fizzy"}, Foo: "fooey"}
+
+	buf := bytes.NewBuffer(nil)
+	if err := MarshalPayload(buf, expected); err != nil {
+		t.Fatal(err)
+	}
+	payload := buf.Bytes()
+
+	resp := new(OnePayload)
+	if err := json.Unmarshal(payload, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Type != "models" || resp.Data.ID != "7" {
+		t.Fatalf("Was expecting models 7, got %s %s", resp.Data.Type, resp.Data.ID)
+	}
+
+	dst := &Model{}
+	if err := UnmarshalPayload(bytes.NewReader(payload), dst); err != nil {
 		t.Fatal(err)
 	}
+	if !reflect.DeepEqual(expected, dst) {
+		t.Fatalf("Got\n%#v\n%#v\nExpected\n%#v\n%#v\n", dst, dst.Thing, expected, expected.Thing)
+	}
 
+	resp.Data.Type = "things"
+	if payload, err := json.Marshal(resp); err != nil {
+		t.Fatal(err)
+	} else if err := UnmarshalPayload(bytes.NewReader(payload), &Model{}); err == nil {
+		t.Fatal("Was expecting an error unmarshaling a things resource into a models model")
+	}
+
+	// Resources being created, without an id, are type checked too
+	for _, body := range []string{
+		`{"data": {"type": "things", "attributes": {"foo": "fooey"}}}`,
+		`{"data": {"type": "blogs", "attributes": {"title": "Title"}}}`,
+	} {
+		var dst interface{} = &Model{}
+		if strings.Contains(body, "blogs") {
+			dst = &Post{}
+		}
+		if err := UnmarshalPayload(strings.NewReader(body), dst); err == nil {
+			t.Fatalf("Was expecting a type error for %s", body)
+		}
+	}
 }
 
 func TestMarshalUnmarshalCompositeStruct_Errors(t *testing.T) {
@@ -1244,7 +3265,7 @@ func TestMarshalUnmarshalCompositeStruct_Errors(t *testing.T) {
 	}
 
 	type Model struct {
-		*Thing `jsonapi:"embedded,models"`
+		*Thing `jsonapi:"extends,models"`
 		Foo    string `jsonapi:"attr,foo"`
 		Bar    string `jsonapi:"attr,bar"`
 		Bat    string `jsonapi:"attr,bat"`
@@ -1284,7 +3305,7 @@ func TestMarshalUnmarshalCompositeStruct_Errors(t *testing.T) {
 		// get the expected model and marshal to jsonapi
 		buf := bytes.NewBuffer(nil)
 		if err := MarshalPayload(buf, scenario.dst); err != scenario.expected {
-			t.Errorf("Dst\n%#v\nGot\n%#v\nExpected\n%#v\n", scenario.dst.ID, err, scenario.expected)
+			t.Errorf("Dst\n%#v\nGot\n%#v\nExpected\n%#v\n", scenario.dst, err, scenario.expected)
 		}
 	}
 }
@@ -45,24 +45,24 @@ func (r *Runtime) shouldInstrument() bool {
 	return Instrumentation != nil
 }
 
-func (r *Runtime) UnmarshalPayload(reader io.Reader, model interface{}) error {
+func (r *Runtime) UnmarshalPayload(reader io.Reader, model interface{}, opts ...Option) error {
 	return r.instrumentCall(UnmarshalStart, UnmarshalStop, func() error {
-		return UnmarshalPayload(reader, model)
+		return UnmarshalPayload(reader, model, opts...)
 	})
 }
 
-func (r *Runtime) UnmarshalManyPayload(reader io.Reader, kind reflect.Type) (elems []interface{}, err error) {
+func (r *Runtime) UnmarshalManyPayload(reader io.Reader, kind reflect.Type, opts ...Option) (elems []interface{}, err error) {
 	r.instrumentCall(UnmarshalStart, UnmarshalStop, func() error {
-		elems, err = UnmarshalManyPayload(reader, kind)
+		elems, err = UnmarshalManyPayload(reader, kind, opts...)
 		return err
 	})
 
 	return
 }
 
-func (r *Runtime) MarshalPayload(w io.Writer, model interface{}) error {
+func (r *Runtime) MarshalPayload(w io.Writer, model interface{}, opts ...Option) error {
 	return r.instrumentCall(MarshalStart, MarshalStop, func() error {
-		return MarshalPayload(w, model)
+		return MarshalPayload(w, model, opts...)
 	})
 }
 
@@ -0,0 +1,115 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+// streamFlushInterval is the number of resources StreamMarshalMany writes
+// between flushes of a flushable writer.
+const streamFlushInterval = 100
+
+// StreamMarshalMany writes a jsonapi collection response of the models
+// received from models until it is closed, encoding each resource as it
+// arrives rather than building the whole document first. Related resources
+// are deduplicated and written once, as "included", after the data, so memory
+// grows with the number of distinct related resources rather than with the
+// number of models, e.g. for an export sharing a few reference resources.
+// When the related resources are mostly distinct, pass WithMaxIncludeDepth(0)
+// to only link them, leaving "included" out and memory bounded.
+//
+// When w has a Flush method, e.g. a *gzip.Writer or an http.Flusher, it is
+// flushed periodically so that it can compress or send the data incrementally.
+// The models should be struct pointers; the caller must drain or close the
+// channel if an error is returned.
+func StreamMarshalMany(w io.Writer, models <-chan interface{}, opts ...Option) error {
+	o := newOptions(opts)
+	if o.err != nil {
+		return o.err
+	}
+	included := map[string]*Node{}
+
+	if _, err := io.WriteString(w, `{"data":[`); err != nil {
+		return err
+	}
+
+	i := 0
+	for model := range models {
+		node, err := visitModelNode(model, &included, true, 0, o)
+		if err != nil {
+			return &MarshalError{
+				Index: i,
+				Type:  primaryType(reflect.TypeOf(model)),
+				ID:    primaryID(model, o),
+				Err:   err,
+			}
+		}
+		if err := checkIncludedCount(included, o); err != nil {
+			return err
+		}
+		finishPayload(&ManyPayload{Data: []*Node{node}}, o)
+
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := writeJSON(w, node); err != nil {
+			return err
+		}
+
+		i++
+		if i%streamFlushInterval == 0 {
+			if err := flush(w); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return err
+	}
+
+	if len(included) > 0 {
+		payload := &ManyPayload{Included: nodeMapValues(&included)}
+		finishPayload(payload, o)
+
+		if _, err := io.WriteString(w, `,"included":`); err != nil {
+			return err
+		}
+		if err := writeJSON(w, payload.Included); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.WriteString(w, "}\n"); err != nil {
+		return err
+	}
+
+	return flush(w)
+}
+
+// writeJSON writes v encoded as JSON, without the newline a json.Encoder
+// would add.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// flush flushes w if it buffers its output, as a *gzip.Writer, *bufio.Writer
+// or http.Flusher does.
+func flush(w io.Writer) error {
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}